@@ -35,14 +35,29 @@ Example usage:
       "//foo/bar/cmd/ip_lib",
     ],
   )
+
+  Gazelle can generate go_busybox_library and go_busybox_binary targets with
+  the extension in //gazelle/busybox, e.g. with these directives:
+
+  # gazelle:busybox_library on
+  # gazelle:busybox_binary bb
+
+  go_busybox_multiarch builds a go_busybox_binary for several platforms at
+  once.
+
+  To put the busybox and its /bbin symlinks into an image, use :bb_bbin, a
+  tar archive, as one of pkg_tar's deps.
 """
 
-load("@io_bazel_rules_go//go:def.bzl", "go_binary", "go_context", "go_library", "go_rule")
-load("@io_bazel_rules_go//go/private:providers.bzl", "GoArchive", "GoLibrary", "GoSource")
+load("@io_bazel_rules_go//go:def.bzl", "GoArchive", "GoInfo", "go_binary", "go_context", "go_library")
 
 GoDepsInfo = provider("transitive_files")
 CommandNamesInfo = provider("cmd_names")
 
+# Published by uroot_rewrite_ast, so that busyboxes can check that they were
+# configured like their commands.
+RewrittenCommandInfo = provider(fields = ["intercept_exit"])
+
 def _get_transitive_files(rulectx):
     directs = []
     transitives = []
@@ -63,6 +78,23 @@ def _go_dep_aspect(target, ctx):
 # the tree.
 go_dep_aspect = aspect(implementation = _go_dep_aspect)
 
+def _release_tags(goc):
+    """Returns the release tags of the Go SDK, e.g. go1.1 to go1.16 for Go 1.16.
+
+    Args:
+      goc: go_context of the rule.
+
+    Returns:
+      The list of release tags, or an empty list if the SDK version is unknown.
+    """
+    version = getattr(goc.sdk, "version", "")
+    if version.startswith("go"):
+        version = version[2:]
+    parts = version.split(".")
+    if len(parts) < 2 or parts[0] != "1" or not parts[1].isdigit():
+        return []
+    return ["go1.%d" % minor for minor in range(1, int(parts[1]) + 1)]
+
 def _uroot_rewrite_ast(ctx):
     """Rewrite one Go command to be a library.
 
@@ -81,13 +113,39 @@ def _uroot_rewrite_ast(ctx):
     args.add("--package", ctx.attr.package_name)
 
     goc = go_context(ctx)
-    for archive in goc.stdlib.libs:
+    for archive in goc.stdlib.libs.to_list():
         args.add("--archive", archive.path)
 
+    # Select source files exactly as rules_go does for this configuration.
+    args.add("--goos", goc.mode.goos)
+    args.add("--goarch", goc.mode.goarch)
+    args.add("--cgo=%s" % ("false" if goc.mode.pure else "true"))
+    args.add_joined("--tags", goc.mode.tags, join_with = ",", omit_if_empty = True)
+    args.add_joined("--release_tags", _release_tags(goc), join_with = ",", omit_if_empty = True)
+
     inputs = _get_transitive_files(ctx)
     for f in inputs.to_list():
         args.add("--archive", f.path)
 
+    # Map every dependency's package path to its archive, so that packages
+    # with the same base name, and vendored packages, are not confused.
+    # Export data refers to packages by importmap, which differs from the
+    # import path for vendored packages. Like rules_go's importcfg, direct
+    # dependencies are also mapped by the import path the sources use.
+    archive_files = []
+    for d in ctx.attr.deps:
+        if GoArchive not in d:
+            continue
+        archive = d[GoArchive]
+        for data in [archive.data] + archive.transitive.to_list():
+            f = getattr(data, "export_file", None) or data.file
+            args.add("--importmap", "%s=%s" % (data.importmap, f.path))
+            archive_files.append(f)
+        data = archive.data
+        if data.importpath != data.importmap:
+            f = getattr(data, "export_file", None) or data.file
+            args.add("--importmap", "%s=%s" % (data.importpath, f.path))
+
     output_dir = None
     outputs = []
     for f in ctx.files.srcs:
@@ -101,18 +159,26 @@ def _uroot_rewrite_ast(ctx):
         if not output_dir:
             output_dir = outf.dirname
 
+    # Exits are routed through a generated bbexit.go.
+    if ctx.attr.intercept_exit:
+        args.add("--intercept_exit")
+        outputs.append(ctx.actions.declare_file("gen/bbexit.go"))
+
     args.add("--dest_dir", output_dir)
 
     # Run the rewrite_ast binary.
     ctx.actions.run(
-        inputs = depset(ctx.files.srcs, transitive = [inputs, depset(goc.stdlib.libs)]),
+        inputs = depset(ctx.files.srcs + archive_files, transitive = [inputs, goc.stdlib.libs]),
         outputs = outputs,
         arguments = [args],
         executable = ctx.executable._rewrite_ast,
     )
 
     # This makes the target usable as a stand-in for a set of files.
-    return [DefaultInfo(files = depset(outputs))]
+    return [
+        DefaultInfo(files = depset(outputs)),
+        RewrittenCommandInfo(intercept_exit = ctx.attr.intercept_exit),
+    ]
 
 # Example usage:
 #
@@ -137,7 +203,7 @@ def _uroot_rewrite_ast(ctx):
 #   ],
 #   deps = [...],
 # )
-uroot_rewrite_ast = go_rule(
+uroot_rewrite_ast = rule(
     attrs = {
         "srcs": attr.label_list(
             mandatory = True,
@@ -154,20 +220,22 @@ uroot_rewrite_ast = go_rule(
         "command_name": attr.string(
             mandatory = True,
         ),
-        "_stdlib": attr.label(
-            default = Label("@io_bazel_rules_go//:stdlib"),
+        "intercept_exit": attr.bool(),
+        "_go_context_data": attr.label(
+            default = Label("@io_bazel_rules_go//:go_context_data"),
         ),
         "_rewrite_ast": attr.label(
             executable = True,
-            cfg = "host",
+            cfg = "exec",
             allow_files = True,
             default = Label("//cmd/rewritepkg"),
         ),
     },
     implementation = _uroot_rewrite_ast,
+    toolchains = ["@io_bazel_rules_go//go:toolchain"],
 )
 
-def go_busybox_library(name, srcs, importpath, deps = [], **kwargs):
+def go_busybox_library(name, srcs, importpath, deps = [], intercept_exit = False, **kwargs):
     """go_busybox_library builds a u-root busybox-compatible Go package.
 
     Defines both a _uroot Go library, and a go_binary so it can be used as a
@@ -183,6 +251,8 @@ def go_busybox_library(name, srcs, importpath, deps = [], **kwargs):
         srcs: set of source files to be compiled by this rule.
         importpath: Go import path for the package.
         deps: set of dependencies present in the source files.
+        intercept_exit: route exits of the command through the busybox exit
+                        hooks. The busybox must set intercept_exit as well.
         **kwargs: kwargs to use with the generated go_library and go_binary rules.
     """
 
@@ -192,6 +262,7 @@ def go_busybox_library(name, srcs, importpath, deps = [], **kwargs):
         package_name = "%s/main" % native.package_name(),
         srcs = srcs,
         command_name = name,
+        intercept_exit = intercept_exit,
         # We need all dependencies to be built in order to use their type
         # information, which is read from the generated object files.
         #
@@ -218,6 +289,22 @@ def go_busybox_library(name, srcs, importpath, deps = [], **kwargs):
         **kwargs
     )
 
+def _command_name(importpath):
+    """Returns the default name of the command with the given import path.
+
+    Like makebb, it is the base name of the command's import path, which is
+    that of the go_busybox_library without the _uroot suffix.
+
+    Args:
+        importpath: import path of the rewritten command.
+
+    Returns:
+        The command name.
+    """
+    if importpath.endswith("_uroot"):
+        importpath = importpath[:-len("_uroot")]
+    return importpath.split("/")[-1]
+
 def _uroot_make_main_template(ctx):
     """_uroot_make_main creates main.go dispatcher for our Go busybox.
 
@@ -233,11 +320,11 @@ def _uroot_make_main_template(ctx):
     output_dir = None
 
     args = ctx.actions.args()
-    args.add("--template_pkg", "%s/main" % ctx.attr._template.label.package)
+    args.add("--template_pkg", "%s/main" % ctx.attr.template.label.package)
 
     outputs = []
     inputs = []
-    for f in ctx.attr._template[GoArchive].source.srcs:
+    for f in ctx.attr.template[GoArchive].source.srcs:
         args.add("--package_file", f.path)
         inputs.append(f)
 
@@ -246,11 +333,54 @@ def _uroot_make_main_template(ctx):
         if not output_dir:
             output_dir = outf.dirname
 
+    # bb.RegisterFile, which registers the commands with the template.
+    outputs.append(ctx.actions.declare_file("%s_bbgen/zz_bbregister.go" % ctx.attr.name))
+
     args.add("--dest_dir", output_dir)
 
-    # Stuff to import.
-    for dep in ctx.attr.cmds:
-        args.add("--command", dep[GoLibrary].importpath)
+    # Stuff to import, by command name.
+    names = []
+    for i, dep in enumerate(ctx.attr.cmds):
+        importpath = dep[GoInfo].importpath
+        name = ctx.attr.cmd_names[i] if i < len(ctx.attr.cmd_names) else ""
+        if not name:
+            name = _command_name(importpath)
+        if name in names:
+            fail("Two commands have the same name '%s'" % name)
+        names.append(name)
+        args.add("--command", "%s=%s" % (name, importpath))
+
+    aliases = sorted(ctx.attr.aliases.keys())
+    for alias in aliases:
+        if alias in names:
+            fail("Alias '%s' is also the name of a command" % alias)
+        if ctx.attr.aliases[alias] not in names:
+            fail("Alias '%s' is for '%s', which is not one of the commands" % (alias, ctx.attr.aliases[alias]))
+        args.add("--alias", "%s=%s" % (alias, ctx.attr.aliases[alias]))
+    if ctx.attr.default_cmd and ctx.attr.default_cmd not in names + aliases:
+        fail("Default command '%s' is not one of the commands" % ctx.attr.default_cmd)
+
+    # The generated main only compiles if it sets the exit hooks of exactly
+    # the commands that have them. Synopses of commands are read from their
+    # package documentation.
+    intercept_exit = ctx.attr.intercept_exit or ctx.attr.exit_panics
+    for i, rewrite in enumerate(ctx.attr.rewrites):
+        for f in rewrite[DefaultInfo].files.to_list():
+            args.add("--command_source", "%s=%s" % (names[i], f.path))
+            inputs.append(f)
+        if rewrite[RewrittenCommandInfo].intercept_exit != intercept_exit:
+            fail("Command '%s' has intercept_exit = %s, but the busybox %s; set intercept_exit on both or neither" % (
+                names[i],
+                rewrite[RewrittenCommandInfo].intercept_exit,
+                "has intercept_exit or exit_panics" if intercept_exit else "does not",
+            ))
+
+    if ctx.attr.intercept_exit:
+        args.add("--intercept_exit")
+    if ctx.attr.exit_panics:
+        args.add("--exit_panics")
+    if ctx.attr.default_cmd:
+        args.add("--default_cmd", ctx.attr.default_cmd)
 
     # Run the make_main binary.
     ctx.actions.run(
@@ -263,27 +393,38 @@ def _uroot_make_main_template(ctx):
     # This makes the target usable as a stand-in for a set of files.
     return [
         DefaultInfo(files = depset(outputs)),
-        CommandNamesInfo(cmd_names = ctx.attr.cmd_names),
+        CommandNamesInfo(cmd_names = names + aliases),
     ]
 
-uroot_make_main_template = go_rule(
+uroot_make_main_template = rule(
     attrs = {
         "cmds": attr.label_list(
             mandatory = True,
-            providers = [GoSource],
+            providers = [GoInfo],
             allow_rules = ["go_library"],
         ),
-        "cmd_names": attr.string_list(
-            mandatory = True,
+        # Names of cmds, by index. Empty names default to the base name
+        # of the command's import path.
+        "cmd_names": attr.string_list(),
+        # uroot_rewrite_ast targets of cmds, by index.
+        "rewrites": attr.label_list(
+            providers = [RewrittenCommandInfo],
         ),
-        "_template": attr.label(
+        # Additional names of commands, by alias.
+        "aliases": attr.string_dict(),
+        "intercept_exit": attr.bool(),
+        "exit_panics": attr.bool(),
+        "default_cmd": attr.string(),
+        # A go_binary of the main package that registers and dispatches
+        # commands, see bb.CreateBBMainSourceWithOpts.
+        "template": attr.label(
             providers = [GoArchive],
             allow_rules = ["go_binary"],
             default = Label("//pkg/bb/bbmain/cmd"),
         ),
         "_make_main": attr.label(
             executable = True,
-            cfg = "host",
+            cfg = "exec",
             allow_files = True,
             default = Label("//cmd/makebbmain"),
         ),
@@ -291,31 +432,218 @@ uroot_make_main_template = go_rule(
     implementation = _uroot_make_main_template,
 )
 
-def go_busybox_binary(name, commands = [], **kwargs):
+def _go_busybox_bbin(ctx):
+    """_go_busybox_bbin archives a busybox with a symlink for each command.
+
+    Args:
+        ctx: rule context.
+
+    Returns:
+        The tar archive.
+    """
+    out = ctx.actions.declare_file("%s.tar" % ctx.attr.name)
+
+    args = ctx.actions.args()
+    args.add("--bb", ctx.file.binary)
+    args.add("--dir", ctx.attr.dir)
+    args.add("--o", out)
+    for name in ctx.attr.main[CommandNamesInfo].cmd_names:
+        args.add("--command", name)
+
+    ctx.actions.run(
+        inputs = [ctx.file.binary],
+        outputs = [out],
+        arguments = [args],
+        executable = ctx.executable._make_tar,
+    )
+    return [DefaultInfo(files = depset([out]))]
+
+# Example usage:
+#
+# go_busybox_bbin(
+#   name = "bb_bbin",
+#   binary = ":bb",
+#   main = ":bb_gen_main",
+# )
+#
+# pkg_tar(
+#   name = "initramfs",
+#   deps = [":bb_bbin"],
+#   ...
+# )
+go_busybox_bbin = rule(
+    attrs = {
+        "binary": attr.label(
+            mandatory = True,
+            allow_single_file = True,
+        ),
+        # The main package of the busybox, whose CommandNamesInfo names
+        # the symlinks.
+        "main": attr.label(
+            mandatory = True,
+            providers = [CommandNamesInfo],
+        ),
+        "dir": attr.string(
+            default = "bbin",
+        ),
+        "_make_tar": attr.label(
+            executable = True,
+            cfg = "exec",
+            allow_files = True,
+            default = Label("//cmd/makebbtar"),
+        ),
+    },
+    implementation = _go_busybox_bbin,
+)
+
+def _platforms_transition_impl(settings, attr):
+    _ = settings  # unused.
+    return {
+        platform: {"//command_line_option:platforms": "@io_bazel_rules_go//go/toolchain:%s" % platform}
+        for platform in attr.platforms
+    }
+
+# Builds the busybox once per platform in go_busybox_multiarch's platforms.
+#
+# Tools like rewritepkg still run in the exec configuration, while the
+# go_context of the rules between them is that of the target platform, so
+# commands are rewritten for the target's GOOS and GOARCH.
+_platforms_transition = transition(
+    implementation = _platforms_transition_impl,
+    inputs = [],
+    outputs = ["//command_line_option:platforms"],
+)
+
+def _go_busybox_multiarch(ctx):
+    """_go_busybox_multiarch collects a busybox for each platform.
+
+    Args:
+        ctx: rule context.
+
+    Returns:
+        A directory with PLATFORM/bb for each platform, and an output group
+        per platform with only its busybox.
+    """
+    out = ctx.actions.declare_directory(ctx.attr.name)
+
+    args = ctx.actions.args()
+    args.add(out.path)
+    inputs = []
+    groups = {}
+    for platform in sorted(ctx.split_attr.binary.keys()):
+        bb = ctx.split_attr.binary[platform][DefaultInfo].files_to_run.executable
+        args.add("%s=%s" % (platform, bb.path))
+        inputs.append(bb)
+        groups[platform] = depset([bb])
+
+    ctx.actions.run_shell(
+        inputs = inputs,
+        outputs = [out],
+        arguments = [args],
+        command = """
+out="$1"
+shift
+for p in "$@"; do
+  mkdir -p "$out/${p%%=*}"
+  cp "${p#*=}" "$out/${p%%=*}/bb"
+done
+""",
+        mnemonic = "GoBusyboxMultiarch",
+    )
+    return [
+        DefaultInfo(files = depset([out])),
+        OutputGroupInfo(**groups),
+    ]
+
+# Example usage:
+#
+# go_busybox_multiarch(
+#   name = "bb_all",
+#   binary = ":bb",
+#   platforms = ["linux_amd64", "linux_arm64"],
+# )
+#
+# bazel build :bb_all yields bb_all/linux_amd64/bb and bb_all/linux_arm64/bb,
+# and bazel build :bb_all --output_groups=linux_arm64 only the arm64 busybox.
+go_busybox_multiarch = rule(
+    attrs = {
+        # A go_busybox_binary.
+        "binary": attr.label(
+            mandatory = True,
+            executable = True,
+            cfg = _platforms_transition,
+        ),
+        # GOOS_GOARCH names of rules_go platforms.
+        "platforms": attr.string_list(
+            default = [
+                "linux_amd64",
+                "linux_arm64",
+                "linux_arm",
+                "linux_riscv64",
+            ],
+        ),
+        "_allowlist_function_transition": attr.label(
+            default = "@bazel_tools//tools/allowlists/function_transition_allowlist",
+        ),
+    },
+    implementation = _go_busybox_multiarch,
+)
+
+def go_busybox_binary(name, commands = [], names = {}, aliases = {}, intercept_exit = False, exit_panics = False, default_cmd = "", pure = "on", template = None, **kwargs):
     """Generates a busybox binary of many Go commands.
 
     This generates a busybox target binary :name, which strips all debug
     symbols, and a binary with debug symbols can be obtained using :name_debug.
 
+    :name_bbin is a tar archive of the binary as bbin/bb and a symlink
+    bbin/CMD -> bb for each command, which can be used in pkg_tar's deps.
+
     Args:
       name: binary name.
       commands: commands to include. Must be go_busybox_library macro
-                invocations.
+                invocations. Commands are named after the base name of their
+                import path, like with makebb.
+      names: command names by command label, overriding the default, e.g. to
+             include two commands with the same base name.
+      aliases: additional names of commands, e.g. {"[": "test"}. Aliases get
+               symlinks in :name_bbin as well.
+      intercept_exit: the commands were built with intercept_exit. The build
+                      fails if a command's intercept_exit differs.
+      exit_panics: make intercepted exits panic, so that deferred functions of
+                   commands run. Implies intercept_exit. A command that
+                   calls recover() itself also recovers its exits.
+      default_cmd: name of the command or alias to run if neither argv[0]
+                   nor argv[1] name a command.
+      pure: go_binary's pure, "on" to build without cgo. Commands that use
+            cgo must have been rewritten with cgo enabled as well.
+      template: go_binary of the main package that registers and dispatches
+                the commands as documented by bb.CreateBBMainSourceWithOpts,
+                instead of //pkg/bb/bbmain/cmd. It may only import the
+                standard library.
       **kwargs: additional arguments to pass to go_binary.
     """
     cmds = []
+    rewrites = []
     cmd_names = []
     for c in commands:
         cl = Label(c)
-        if cl.name in cmd_names:
-            fail("Two commands have the same name '%s'" % cl.name)
         cmds.append("//%s:%s_uroot" % (cl.package, cl.name))
-        cmd_names.append(cl.name)
+        rewrites.append("//%s:%s_uroot_rewrite" % (cl.package, cl.name))
+        cmd_names.append(names.get(c, ""))
+    for c in names:
+        if c not in commands:
+            fail("names has '%s', which is not one of the commands" % c)
 
     uroot_make_main_template(
         name = "%s_gen_main" % name,
         cmds = cmds,
         cmd_names = cmd_names,
+        rewrites = rewrites,
+        aliases = aliases,
+        intercept_exit = intercept_exit,
+        exit_panics = exit_panics,
+        default_cmd = default_cmd,
+        template = template,
     )
 
     go_binary(
@@ -323,7 +651,7 @@ def go_busybox_binary(name, commands = [], **kwargs):
         srcs = [":%s_gen_main" % name],
         # Strip all debug symbols.
         gc_linkopts = ["-s", "-w"],
-        pure = "on",
+        pure = pure,
         deps = cmds + ["//pkg/bb"],
         **kwargs
     )
@@ -331,7 +659,14 @@ def go_busybox_binary(name, commands = [], **kwargs):
     go_binary(
         name = "%s_debug" % name,
         srcs = [":%s_gen_main" % name],
-        pure = "on",
+        pure = pure,
         deps = cmds + ["//pkg/bb"],
         **kwargs
     )
+
+    go_busybox_bbin(
+        name = "%s_bbin" % name,
+        binary = ":%s" % name,
+        main = ":%s_gen_main" % name,
+        visibility = kwargs.get("visibility"),
+    )
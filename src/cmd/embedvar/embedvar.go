@@ -1,35 +1,501 @@
-// embedvar generates a Go file containing one variable containing one file.
+// embedvar generates a Go file containing one variable containing files.
+//
+// By default, the variable is a []byte with the contents of one file. With
+// -type=map or -type=fs, any number of files and directories are embedded into
+// a map[string][]byte or an fs.FS, keyed by slash-separated paths relative to
+// -root. Files in directories whose names begin with "." or "_" are left out,
+// as with //go:embed.
+//
+// -gzip compresses the embedded files. Values of type []byte then become
+// func() []byte, which decompresses the file on its first call; an fs.FS
+// decompresses a file when it is first opened.
+//
+// -goembed emits a //go:embed declaration instead of the files' contents, for
+// toolchains that support it. Embedded files must then be in the directory of
+// the output file or below.
+//
+// The output only depends on the flags and the embedded files.
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"errors"
 	"flag"
 	"fmt"
+	"go/format"
 	"io/ioutil"
 	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"text/template"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/u-root/gobusybox/src/pkg/uflag"
 )
 
 var (
 	pkg     = flag.String("p", "", "Package name")
-	file    = flag.String("file", "", "File name to embed")
 	o       = flag.String("o", "", "Output file name")
 	varName = flag.String("varname", "", "Variable name to use")
+	typ     = flag.String("type", "bytes", "Variable type: bytes for a []byte with one file, map for a map[string][]byte, or fs for an fs.FS")
+	root    = flag.String("root", "", "Directory that map and fs keys are relative to (default: the directory of -o)")
+	gz      = flag.Bool("gzip", false, "Compress embedded files and decompress them lazily")
+	goEmbed = flag.Bool("goembed", false, "Emit a //go:embed declaration instead of the files' contents")
+	files   uflag.Strings
 )
 
-func main() {
-	flag.Parse()
+func init() {
+	flag.Var(&files, "file", "File or directory to embed (may be repeated)")
+}
+
+// options are the parameters of the generated file.
+type options struct {
+	pkg     string
+	varName string
+	typ     string
+	root    string
+	gzip    bool
+	goEmbed bool
+	// out is the output file; it is not written by generate.
+	out   string
+	files []string
+}
+
+// entry is a file to embed.
+type entry struct {
+	// name is the key of the file in maps and file systems.
+	name    string
+	content []byte
+	// size is the size of the file, which differs from len(content) once
+	// content is compressed.
+	size int
+}
+
+// collect reads the files and the files in directories of paths.
+//
+// Entries are sorted by name. Files that are named more than once are
+// embedded once. If inRoot is set, files must be in root, as their names are
+// used as keys.
+func collect(root string, paths []string, inRoot bool) ([]entry, error) {
+	var entries []entry
+	seen := make(map[string]bool)
+	add := func(p string) error {
+		name := filepath.ToSlash(p)
+		if rel, err := filepath.Rel(root, p); err == nil {
+			name = filepath.ToSlash(rel)
+		} else if inRoot {
+			return err
+		}
+		if inRoot && (name == ".." || strings.HasPrefix(name, "../")) {
+			return fmt.Errorf("%s is not in %s", p, root)
+		}
+		if seen[name] {
+			return nil
+		}
+		seen[name] = true
+
+		content, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry{name: name, content: content, size: len(content)})
+		return nil
+	}
 
-	content, err := ioutil.ReadFile(*file)
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			if err := add(p); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		err = filepath.Walk(p, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if file != p && (strings.HasPrefix(info.Name(), ".") || strings.HasPrefix(info.Name(), "_")) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if info.IsDir() {
+				return nil
+			}
+			return add(file)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+	return entries, nil
+}
+
+// dirs returns the sorted names of the children of each directory of the
+// entries.
+func dirs(entries []entry) map[string][]string {
+	children := map[string]map[string]bool{".": {}}
+	for _, e := range entries {
+		for name := e.name; name != "."; name = path.Dir(name) {
+			dir := path.Dir(name)
+			if children[dir] == nil {
+				children[dir] = make(map[string]bool)
+			}
+			children[dir][path.Base(name)] = true
+		}
+	}
+	d := make(map[string][]string)
+	for dir, names := range children {
+		d[dir] = []string{}
+		for name := range names {
+			d[dir] = append(d[dir], name)
+		}
+		sort.Strings(d[dir])
+	}
+	return d
+}
+
+// compress gzips b. The gzip header has neither a name nor a modification
+// time, so the output only depends on b.
+func compress(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
 	if err != nil {
-		log.Fatalf("Failed to read file content: %v", err)
+		return nil, err
+	}
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// helperPrefix is the prefix of the unexported helpers of the variable.
+func helperPrefix(varName string) string {
+	r, n := utf8.DecodeRuneInString(varName)
+	return string(unicode.ToLower(r)) + varName[n:]
+}
+
+var gunzipHelper = template.Must(template.New("gunzip").Parse(`
+// {{.}}Gunzip returns a function that decompresses data on its first call.
+func {{.}}Gunzip(data string) func() []byte {
+	var once sync.Once
+	var b []byte
+	return func() []byte {
+		once.Do(func() {
+			r, err := gzip.NewReader(strings.NewReader(data))
+			if err != nil {
+				panic(err)
+			}
+			if b, err = ioutil.ReadAll(r); err != nil {
+				panic(err)
+			}
+		})
+		return b
+	}
+}
+`))
+
+var rawHelper = template.Must(template.New("raw").Parse(`
+// {{.}}Raw returns a function that returns a copy of data.
+func {{.}}Raw(data string) func() []byte {
+	return func() []byte {
+		return []byte(data)
+	}
+}
+`))
+
+var fsHelpers = template.Must(template.New("fs").Parse(`
+// {{.}}FS is a read-only fs.FS.
+type {{.}}FS struct {
+	files map[string]*{{.}}File
+	// dirs are the sorted names of each directory's children.
+	dirs map[string][]string
+}
+
+type {{.}}File struct {
+	size int64
+	data func() []byte
+}
+
+// Open implements fs.FS.Open.
+func (e *{{.}}FS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if f, ok := e.files[name]; ok {
+		return &{{.}}OpenFile{Reader: bytes.NewReader(f.data()), info: e.info(name)}, nil
 	}
+	if children, ok := e.dirs[name]; ok {
+		entries := make([]fs.DirEntry, 0, len(children))
+		for _, child := range children {
+			entries = append(entries, e.info(path.Join(name, child)))
+		}
+		return &{{.}}OpenDir{info: e.info(name), entries: entries}, nil
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
 
-	format := `package %s
+func (e *{{.}}FS) info(name string) {{.}}Info {
+	if f, ok := e.files[name]; ok {
+		return {{.}}Info{name: path.Base(name), size: f.size}
+	}
+	return {{.}}Info{name: path.Base(name), dir: true}
+}
+
+// {{.}}Info implements fs.FileInfo and fs.DirEntry.
+type {{.}}Info struct {
+	name string
+	size int64
+	dir  bool
+}
 
-var %s = []byte(%s)
-`
+func (i {{.}}Info) Name() string { return i.name }
+func (i {{.}}Info) Size() int64  { return i.size }
+func (i {{.}}Info) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+func (i {{.}}Info) ModTime() time.Time          { return time.Time{} }
+func (i {{.}}Info) IsDir() bool                 { return i.dir }
+func (i {{.}}Info) Sys() interface{}            { return nil }
+func (i {{.}}Info) Type() fs.FileMode           { return i.Mode().Type() }
+func (i {{.}}Info) Info() (fs.FileInfo, error) { return i, nil }
 
-	if err := ioutil.WriteFile(*o, []byte(fmt.Sprintf(format, *pkg, *varName, strconv.Quote(string(content)))), 0644); err != nil {
+type {{.}}OpenFile struct {
+	*bytes.Reader
+	info {{.}}Info
+}
+
+func (f *{{.}}OpenFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *{{.}}OpenFile) Close() error               { return nil }
+
+type {{.}}OpenDir struct {
+	info    {{.}}Info
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *{{.}}OpenDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *{{.}}OpenDir) Close() error               { return nil }
+
+func (d *{{.}}OpenDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: fs.ErrInvalid}
+}
+
+// ReadDir implements fs.ReadDirFile.ReadDir.
+func (d *{{.}}OpenDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	entries := d.entries[d.offset:]
+	if n > 0 && len(entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > 0 && n < len(entries) {
+		entries = entries[:n]
+	}
+	d.offset += len(entries)
+	return entries, nil
+}
+`))
+
+var mapFromFS = template.Must(template.New("map").Parse(`
+var {{.Var}} = func() map[string][]byte {
+	m := make(map[string][]byte)
+	err := fs.WalkDir({{.Prefix}}FS, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		m[name], err = {{.Prefix}}FS.ReadFile(name)
+		return err
+	})
+	if err != nil {
+		panic(err)
+	}
+	return m
+}()
+`))
+
+// generate returns the Go file embedding the files of opts.
+func generate(opts *options) ([]byte, error) {
+	if opts.gzip && opts.goEmbed {
+		return nil, errors.New("-gzip and -goembed cannot be combined")
+	}
+	if len(opts.files) == 0 {
+		return nil, errors.New("no files to embed")
+	}
+	outDir := filepath.Dir(opts.out)
+	root := opts.root
+	if root == "" {
+		root = outDir
+	}
+	if opts.goEmbed {
+		absRoot, err := filepath.Abs(root)
+		if err != nil {
+			return nil, err
+		}
+		absOut, err := filepath.Abs(outDir)
+		if err != nil {
+			return nil, err
+		}
+		if absRoot != absOut {
+			return nil, fmt.Errorf("-goembed needs -root to be the directory of %s", opts.out)
+		}
+	}
+
+	// The name of the single file of bytes is only used by //go:embed.
+	entries, err := collect(root, opts.files, opts.typ != "bytes" || opts.goEmbed)
+	if err != nil {
+		return nil, err
+	}
+	if opts.typ == "bytes" {
+		if len(opts.files) != 1 || len(entries) != 1 {
+			return nil, errors.New("-type=bytes embeds exactly one file")
+		}
+	}
+	if opts.gzip {
+		for i := range entries {
+			if entries[i].content, err = compress(entries[i].content); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	prefix := helperPrefix(opts.varName)
+	var imports []string
+	var decl, helpers bytes.Buffer
+	value := func(e entry) string {
+		if opts.gzip {
+			return fmt.Sprintf("%sGunzip(%s)", prefix, strconv.Quote(string(e.content)))
+		}
+		return fmt.Sprintf("[]byte(%s)", strconv.Quote(string(e.content)))
+	}
+
+	switch {
+	case opts.goEmbed:
+		var patterns []string
+		for _, f := range opts.files {
+			rel, err := filepath.Rel(root, f)
+			if err != nil {
+				return nil, err
+			}
+			patterns = append(patterns, strconv.Quote(filepath.ToSlash(rel)))
+		}
+		directive := "//go:embed " + strings.Join(patterns, " ")
+		switch opts.typ {
+		case "bytes":
+			imports = append(imports, `_ "embed"`)
+			fmt.Fprintf(&decl, "%s\nvar %s []byte\n", directive, opts.varName)
+		case "map":
+			imports = append(imports, `"embed"`, `"io/fs"`)
+			fmt.Fprintf(&decl, "%s\nvar %sFS embed.FS\n", directive, prefix)
+			if err := mapFromFS.Execute(&decl, map[string]string{"Var": opts.varName, "Prefix": prefix}); err != nil {
+				return nil, err
+			}
+		case "fs":
+			imports = append(imports, `"embed"`)
+			fmt.Fprintf(&decl, "%s\nvar %s embed.FS\n", directive, opts.varName)
+		}
+
+	case opts.typ == "bytes":
+		fmt.Fprintf(&decl, "var %s = %s\n", opts.varName, value(entries[0]))
+
+	case opts.typ == "map":
+		valueType := "[]byte"
+		if opts.gzip {
+			valueType = "func() []byte"
+		}
+		fmt.Fprintf(&decl, "var %s = map[string]%s{\n", opts.varName, valueType)
+		for _, e := range entries {
+			fmt.Fprintf(&decl, "%s: %s,\n", strconv.Quote(e.name), value(e))
+		}
+		fmt.Fprintf(&decl, "}\n")
+
+	case opts.typ == "fs":
+		imports = append(imports, `"bytes"`, `"io"`, `"io/fs"`, `"path"`, `"time"`)
+		fmt.Fprintf(&decl, "var %s fs.FS = &%sFS{\nfiles: map[string]*%sFile{\n", opts.varName, prefix, prefix)
+		for _, e := range entries {
+			data := fmt.Sprintf("%sRaw(%s)", prefix, strconv.Quote(string(e.content)))
+			if opts.gzip {
+				data = value(e)
+			}
+			fmt.Fprintf(&decl, "%s: {size: %d, data: %s},\n", strconv.Quote(e.name), e.size, data)
+		}
+		fmt.Fprintf(&decl, "},\ndirs: map[string][]string{\n")
+		d := dirs(entries)
+		var names []string
+		for dir := range d {
+			names = append(names, dir)
+		}
+		sort.Strings(names)
+		for _, dir := range names {
+			var children []string
+			for _, child := range d[dir] {
+				children = append(children, strconv.Quote(child))
+			}
+			fmt.Fprintf(&decl, "%s: {%s},\n", strconv.Quote(dir), strings.Join(children, ", "))
+		}
+		fmt.Fprintf(&decl, "},\n}\n")
+		if !opts.gzip {
+			if err := rawHelper.Execute(&helpers, prefix); err != nil {
+				return nil, err
+			}
+		}
+		if err := fsHelpers.Execute(&helpers, prefix); err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown -type %q, want bytes, map or fs", opts.typ)
+	}
+
+	if opts.gzip {
+		imports = append(imports, `"compress/gzip"`, `"io/ioutil"`, `"strings"`, `"sync"`)
+		if err := gunzipHelper.Execute(&helpers, prefix); err != nil {
+			return nil, err
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by embedvar. DO NOT EDIT.\n\npackage %s\n\n", opts.pkg)
+	if len(imports) > 0 {
+		fmt.Fprintf(&buf, "import (\n%s\n)\n\n", strings.Join(imports, "\n"))
+	}
+	buf.Write(decl.Bytes())
+	buf.Write(helpers.Bytes())
+	return format.Source(buf.Bytes())
+}
+
+func main() {
+	flag.Parse()
+
+	src, err := generate(&options{
+		pkg:     *pkg,
+		varName: *varName,
+		typ:     *typ,
+		root:    *root,
+		gzip:    *gz,
+		goEmbed: *goEmbed,
+		out:     *o,
+		files:   files,
+	})
+	if err != nil {
+		log.Fatalf("Failed to generate %s: %v", *o, err)
+	}
+	if err := ioutil.WriteFile(*o, src, 0644); err != nil {
 		log.Fatalf("Could not write file %s: %v", *o, err)
 	}
 }
@@ -0,0 +1,341 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testFiles = map[string]string{
+	"a.txt":          "a\n",
+	"dir/b.txt":      "b\n",
+	"dir/sub/c.txt":  strings.Repeat("c", 1000),
+	"dir/.hidden":    "hidden",
+	"dir/_ignored/d": "ignored",
+}
+
+// Programs printing the embedded files as name=content lines.
+const (
+	printBytes = `package main
+
+import "fmt"
+
+func main() {
+	fmt.Printf("a.txt=%s", embedded)
+}
+`
+	printLazyBytes = `package main
+
+import "fmt"
+
+func main() {
+	fmt.Printf("a.txt=%s", embedded())
+}
+`
+	printMap = `package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+func main() {
+	var names []string
+	for name := range embedded {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("%s=%s", name, embedded[name])
+	}
+}
+`
+	printLazyMap = `package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+func main() {
+	var names []string
+	for name := range embedded {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("%s=%s", name, embedded[name]())
+	}
+}
+`
+	printFS = `package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"testing/fstest"
+)
+
+func main() {
+	if err := fstest.TestFS(embedded, "a.txt", "dir/b.txt", "dir/sub/c.txt"); err != nil {
+		log.Fatal(err)
+	}
+	err := fs.WalkDir(embedded, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		b, err := fs.ReadFile(embedded, name)
+		fmt.Printf("%s=%s", name, b)
+		return err
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+`
+)
+
+func TestGenerate(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+	dir, err := ioutil.TempDir("", "test-embedvar-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example.com/m\n\ngo 1.16\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	one := "a.txt=a\n"
+	all := "a.txt=a\ndir/b.txt=b\ndir/sub/c.txt=" + testFiles["dir/sub/c.txt"]
+	for _, tt := range []struct {
+		name  string
+		opts  options
+		files []string
+		main  string
+		// otherDir puts the files in another directory than the
+		// output, which only bytes without -goembed allows.
+		otherDir bool
+	}{
+		{
+			name:  "bytes",
+			opts:  options{typ: "bytes"},
+			files: []string{"a.txt"},
+			main:  printBytes,
+		},
+		{
+			name:     "bytes-other-dir",
+			opts:     options{typ: "bytes"},
+			files:    []string{"a.txt"},
+			main:     printBytes,
+			otherDir: true,
+		},
+		{
+			name:  "bytes-gzip",
+			opts:  options{typ: "bytes", gzip: true},
+			files: []string{"a.txt"},
+			main:  printLazyBytes,
+		},
+		{
+			name:     "bytes-gzip-other-dir",
+			opts:     options{typ: "bytes", gzip: true},
+			files:    []string{"a.txt"},
+			main:     printLazyBytes,
+			otherDir: true,
+		},
+		{
+			name:  "bytes-goembed",
+			opts:  options{typ: "bytes", goEmbed: true},
+			files: []string{"a.txt"},
+			main:  printBytes,
+		},
+		{
+			name:  "map",
+			opts:  options{typ: "map"},
+			files: []string{"dir", "a.txt"},
+			main:  printMap,
+		},
+		{
+			name:  "map-gzip",
+			opts:  options{typ: "map", gzip: true},
+			files: []string{"a.txt", "dir"},
+			main:  printLazyMap,
+		},
+		{
+			name:  "map-goembed",
+			opts:  options{typ: "map", goEmbed: true},
+			files: []string{"a.txt", "dir"},
+			main:  printMap,
+		},
+		{
+			name:  "fs",
+			opts:  options{typ: "fs"},
+			files: []string{"a.txt", "dir", "dir/b.txt"},
+			main:  printFS,
+		},
+		{
+			name:  "fs-gzip",
+			opts:  options{typ: "fs", gzip: true},
+			files: []string{"a.txt", "dir"},
+			main:  printFS,
+		},
+		{
+			name:  "fs-goembed",
+			opts:  options{typ: "fs", goEmbed: true},
+			files: []string{"a.txt", "dir"},
+			main:  printFS,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			pkgDir := filepath.Join(dir, tt.name)
+			srcDir := pkgDir
+			if tt.otherDir {
+				srcDir = filepath.Join(dir, tt.name+"-src")
+				if err := os.MkdirAll(pkgDir, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for name, content := range testFiles {
+				path := filepath.Join(srcDir, name)
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := ioutil.WriteFile(filepath.Join(pkgDir, "main.go"), []byte(tt.main), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			opts := tt.opts
+			opts.pkg = "main"
+			opts.varName = "embedded"
+			opts.out = filepath.Join(pkgDir, "embedded.go")
+			for _, f := range tt.files {
+				opts.files = append(opts.files, filepath.Join(srcDir, f))
+			}
+			src, err := generate(&opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			again, err := generate(&opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(src, again) {
+				t.Errorf("generate is not deterministic:\n%s\nand\n%s", src, again)
+			}
+			if err := ioutil.WriteFile(opts.out, src, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			cmd := exec.Command("go", "run", ".")
+			cmd.Dir = pkgDir
+			cmd.Env = append(os.Environ(), "GOPROXY=off", "GO111MODULE=on", "GOFLAGS=-mod=mod")
+			var stderr bytes.Buffer
+			cmd.Stderr = &stderr
+			out, err := cmd.Output()
+			if err != nil {
+				t.Fatalf("go run: %v\n%s\ngenerated:\n%s", err, stderr.String(), src)
+			}
+			want := all
+			if tt.opts.typ == "bytes" {
+				want = one
+			}
+			if string(out) != want {
+				t.Errorf("embedded files are\n%s\nwant\n%s", out, want)
+			}
+		})
+	}
+}
+
+func TestGenerateErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-embedvar-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pkgDir := filepath.Join(dir, "pkg")
+	for _, name := range []string{"pkg/a.txt", "pkg/b.txt", "outside.txt"} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out := filepath.Join(pkgDir, "embedded.go")
+	a, b := filepath.Join(pkgDir, "a.txt"), filepath.Join(pkgDir, "b.txt")
+	for _, tt := range []struct {
+		name string
+		opts options
+		want string
+	}{
+		{
+			name: "no files",
+			opts: options{typ: "map"},
+			want: "no files to embed",
+		},
+		{
+			name: "bytes with two files",
+			opts: options{typ: "bytes", files: []string{a, b}},
+			want: "exactly one file",
+		},
+		{
+			name: "bytes with directory",
+			opts: options{typ: "bytes", files: []string{pkgDir}},
+			want: "exactly one file",
+		},
+		{
+			name: "gzip and goembed",
+			opts: options{typ: "fs", gzip: true, goEmbed: true, files: []string{a}},
+			want: "cannot be combined",
+		},
+		{
+			name: "outside root",
+			opts: options{typ: "fs", files: []string{filepath.Join(dir, "outside.txt")}},
+			want: "is not in",
+		},
+		{
+			name: "bytes goembed outside root",
+			opts: options{typ: "bytes", goEmbed: true, files: []string{filepath.Join(dir, "outside.txt")}},
+			want: "is not in",
+		},
+		{
+			name: "goembed with root",
+			opts: options{typ: "fs", goEmbed: true, root: dir, files: []string{a}},
+			want: "-goembed needs -root",
+		},
+		{
+			name: "unknown type",
+			opts: options{typ: "tar", files: []string{a}},
+			want: "unknown -type",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			opts.pkg = "main"
+			opts.varName = "embedded"
+			opts.out = out
+			if _, err := generate(&opts); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("generate = %v, want error containing %q", err, tt.want)
+			}
+		})
+	}
+}
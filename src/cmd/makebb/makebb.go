@@ -3,34 +3,93 @@
 // license that can be found in the LICENSE file.
 
 // makebb compiles many Go commands into one bb-style binary.
+//
+//	makebb [flags] CMD...
+//
+// In verify mode, it instead checks that each command behaves the same in the
+// busybox as when compiled on its own, running the cases listed in a JSON
+// table file (see bbtest.ParseCases):
+//
+//	makebb verify [flags] CASES CMD...
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
 
+	"github.com/google/goterm/term"
 	"github.com/u-root/gobusybox/src/pkg/bb"
+	"github.com/u-root/gobusybox/src/pkg/bb/bbtest"
 	"github.com/u-root/gobusybox/src/pkg/golang"
+	"github.com/u-root/gobusybox/src/pkg/uflag"
 	//"github.com/u-root/u-root/pkg/uroot"
 )
 
-var outputPath = flag.String("o", "bb", "Path to busybox binary")
+var (
+	outputPath = flag.String("o", "bb", "Path to busybox binary")
+	cgo        = flag.Bool("cgo", false, "Build with cgo enabled; commands using cgo are rewritten from their original source files")
+	jobs       = flag.Int("j", 0, "Number of modules to load and commands to rewrite concurrently (0 means number of CPUs)")
+	verbose    = flag.Bool("v", false, "Print how long each build phase takes")
+	keepGoing  = flag.Bool("keep-going", false, "Skip packages that fail to load or are not commands instead of failing the build")
+	manifest   = flag.String("manifest", "", "Manifest file listing (optional) commands to compile in addition to the ones given as arguments")
+	defaultCmd = flag.String("default-cmd", "", "Command to run if neither argv[0] nor argv[1] name a command; overrides the manifest's default")
+	template   = flag.String("template", "", "Directory of the main package that registers and dispatches commands, instead of the built-in one")
+
+	interceptExit = flag.Bool("intercept-exit", false, "Route os.Exit, log.Fatal and flag parsing exits of commands through the busybox exit hooks")
+	exitPanics    = flag.Bool("exit-panics", false, "Make intercepted exits panic, so that deferred functions of commands run; implies -intercept-exit")
+
+	aliases uflag.Strings
+)
+
+func init() {
+	flag.Var(&aliases, "alias", "alias=cmd pair registering alias as another name of the command cmd; may be repeated")
+}
+
+// isTerminal returns true if f is a terminal, in which case we can use ANSI
+// formatting.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
 
 func main() {
-	flag.Parse()
+	verify := len(os.Args) > 1 && os.Args[1] == "verify"
+	if verify {
+		flag.CommandLine.Parse(os.Args[2:])
+	} else {
+		flag.Parse()
+	}
 
 	// Why doesn't the log package export this as a default?
 	l := log.New(os.Stdout, "", log.LstdFlags)
 	env := golang.Default()
-	if env.CgoEnabled {
+	if *cgo {
+		env.CgoEnabled = true
+	} else if env.CgoEnabled {
 		l.Printf("Disabling CGO for u-root...")
 		env.CgoEnabled = false
 	}
 	l.Printf("Build environment: %s", env)
 
 	pkgs := flag.Args()
+	var cases []bbtest.Case
+	if verify {
+		if len(pkgs) == 0 {
+			l.Fatal("Usage: makebb verify [flags] CASES CMD...")
+		}
+		var err error
+		cases, err = bbtest.ReadCases(pkgs[0])
+		if err != nil {
+			l.Fatal(err)
+		}
+		pkgs = pkgs[1:]
+	}
 	/*	if len(pkgs) == 0 {
 			pkgs = []string{"github.com/u-root/u-root/cmds/"}
 		}
@@ -39,12 +98,103 @@ func main() {
 			l.Fatal(err)
 		}*/
 
+	var optionalPkgs []string
+	defaultCommand := *defaultCmd
+	if *manifest != "" {
+		m, err := bb.ReadManifest(*manifest)
+		if err != nil {
+			l.Fatal(err)
+		}
+		pkgs = append(pkgs, m.Commands...)
+		optionalPkgs = m.Optional
+		if defaultCommand == "" {
+			defaultCommand = m.Default
+		}
+	}
+
+	aliasMap := make(map[string]string)
+	for _, a := range aliases {
+		i := strings.Index(a, "=")
+		if i <= 0 || i == len(a)-1 {
+			l.Fatalf("alias %q is not of the form alias=cmd", a)
+		}
+		aliasMap[a[:i]] = a[i+1:]
+	}
+
 	o, err := filepath.Abs(*outputPath)
 	if err != nil {
 		l.Fatal(err)
 	}
 
-	if err := bb.BuildBusybox(env, pkgs, false /* noStrip */, o); err != nil {
+	level := bb.LevelInfo
+	if *verbose {
+		level = bb.LevelDebug
+	}
+	opts := &bb.Opts{
+		Env:          env,
+		CommandPaths: pkgs,
+		BinaryPath:   o,
+		Jobs:         *jobs,
+		Logger:       bb.NewLogger(l, level),
+
+		OptionalCommandPaths: optionalPkgs,
+		KeepGoing:            *keepGoing,
+
+		InterceptExit: *interceptExit,
+		ExitPanics:    *exitPanics,
+
+		DefaultCommand: defaultCommand,
+		Aliases:        aliasMap,
+		Template:       *template,
+	}
+
+	// Abort the build and clean up on the first interrupt.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	go func() {
+		<-sig
+		signal.Stop(sig)
+		cancel()
+	}()
+
+	if verify {
+		mismatches, err := bbtest.Verify(ctx, opts, cases)
+		if err != nil {
+			l.Fatal(err)
+		}
+		for _, m := range mismatches {
+			l.Print(m)
+		}
+		if len(mismatches) > 0 {
+			l.Fatalf("%d of %d cases behave differently in the busybox", len(mismatches), len(cases))
+		}
+		l.Printf("All %d cases behave the same in the busybox", len(cases))
+		return
+	}
+
+	if err := bb.BuildBusyboxContext(ctx, opts); err != nil {
+		if errors.Is(err, context.Canceled) {
+			l.Fatal("Build interrupted")
+		}
+		var conflicts bb.ModuleConflictErrors
+		if errors.As(err, &conflicts) {
+			for _, c := range conflicts {
+				l.Printf("")
+				l.Printf("Conflicting module dependencies on %s:", c.ModulePath)
+				l.Printf("  %s", c.Provenance)
+				l.Printf("  %s", c.OtherProvenance)
+				if c.Replace != "" {
+					suggestion := "Suggestion to resolve"
+					if isTerminal(os.Stdout) {
+						suggestion = term.Bold(suggestion).String()
+					}
+					l.Printf("%s: add `%s` to %s", suggestion, c.Replace, c.GoMod)
+				}
+			}
+			l.Fatal("Conflicting module dependencies found")
+		}
 		l.Fatal(err)
 	}
 }
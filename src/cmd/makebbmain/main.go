@@ -3,13 +3,18 @@
 // license that can be found in the LICENSE file.
 
 // makebbmain adds u-root command package imports to an existing main()
-// template file.
+// template package, in a file registering the commands with it.
 package main
 
 import (
 	"flag"
+	"go/ast"
+	"go/parser"
+	"go/token"
 	"log"
 	"os"
+	"sort"
+	"strings"
 
 	"github.com/u-root/gobusybox/src/pkg/bb"
 	"github.com/u-root/gobusybox/src/pkg/monoimporter"
@@ -22,11 +27,28 @@ var (
 	destDir  = flag.String("dest_dir", "", "Destination directory")
 	pkgFiles uflag.Strings
 	commands uflag.Strings
+	aliases  uflag.Strings
+	sources  uflag.Strings
+
+	interceptExit = flag.Bool("intercept_exit", false, "Commands were rewritten with -intercept_exit")
+	exitPanics    = flag.Bool("exit_panics", false, "Make intercepted exits panic, so that deferred functions of commands run")
+	defaultCmd    = flag.String("default_cmd", "", "Command to run if neither argv[0] nor argv[1] name a command")
 )
 
 func init() {
 	flag.Var(&pkgFiles, "package_file", "package files")
-	flag.Var(&commands, "command", "Go package path for command to import")
+	flag.Var(&commands, "command", "Go package path for command to import, optionally preceded by name= to override the command name")
+	flag.Var(&aliases, "alias", "alias=name pair registering alias as another name of the command name")
+	flag.Var(&sources, "command_source", "name=file pair of a source file of the command name, whose package documentation is the command's synopsis")
+}
+
+// splitPair splits s of the form key=value.
+func splitPair(s string) (string, string, bool) {
+	i := strings.Index(s, "=")
+	if i <= 0 || i == len(s)-1 {
+		return "", "", false
+	}
+	return s[:i], s[i+1:], true
 }
 
 func main() {
@@ -44,7 +66,52 @@ func main() {
 	if err := os.MkdirAll(*destDir, 0755); err != nil {
 		log.Fatal(err)
 	}
-	if err := bb.CreateBBMainSource(p, commands, *destDir); err != nil {
+	opts := &bb.MainOpts{
+		InterceptExit: *interceptExit || *exitPanics,
+		ExitPanics:    *exitPanics,
+
+		DefaultCommand: *defaultCmd,
+		Names:          make(map[string]string),
+		Aliases:        make(map[string]string),
+	}
+	var pkgs []string
+	for _, cmd := range commands {
+		// Import paths cannot contain =.
+		if name, pkg, ok := splitPair(cmd); ok {
+			opts.Names[pkg] = name
+			cmd = pkg
+		}
+		pkgs = append(pkgs, cmd)
+	}
+	for _, a := range aliases {
+		alias, name, ok := splitPair(a)
+		if !ok {
+			log.Fatalf("alias %q is not of the form alias=name", a)
+		}
+		opts.Aliases[alias] = name
+	}
+
+	// Files are searched for package documentation in order, as in
+	// makebb.
+	sort.Strings(sources)
+	srcFset := token.NewFileSet()
+	files := make(map[string][]*ast.File)
+	for _, s := range sources {
+		name, path, ok := splitPair(s)
+		if !ok {
+			log.Fatalf("command source %q is not of the form name=file", s)
+		}
+		f, err := parser.ParseFile(srcFset, path, nil, parser.PackageClauseOnly|parser.ParseComments)
+		if err != nil {
+			log.Fatal(err)
+		}
+		files[name] = append(files[name], f)
+	}
+	opts.Synopses = make(map[string]string)
+	for name, f := range files {
+		opts.Synopses[name] = bb.Synopsis(f)
+	}
+	if err := bb.CreateBBMainSourceWithOpts(p, pkgs, *destDir, opts); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,117 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// makebbtar writes a tar archive of a busybox binary and a symlink to it for
+// each of its commands, e.g.
+//
+//	bbin/bb
+//	bbin/ls -> bb
+//	bbin/ip -> bb
+//
+// The archive is reproducible: entries are sorted and have no timestamps or
+// owners, so it can be merged into images with pkg_tar.
+package main
+
+import (
+	"archive/tar"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/u-root/gobusybox/src/pkg/uflag"
+)
+
+var (
+	bbPath   = flag.String("bb", "", "Path to the busybox binary")
+	dir      = flag.String("dir", "bbin", "Directory of the busybox and the symlinks in the archive")
+	out      = flag.String("o", "", "Path of the tar archive to write")
+	commands uflag.Strings
+)
+
+func init() {
+	flag.Var(&commands, "command", "Name of a busybox command to create a symlink for")
+}
+
+// writeTar writes bb as dir/bb, and a symlink dir/name -> bb for each of
+// names, to w.
+func writeTar(w io.Writer, bb *os.File, dir string, names []string) error {
+	fi, err := bb.Stat()
+	if err != nil {
+		return err
+	}
+	names = append([]string(nil), names...)
+	sort.Strings(names)
+	for i, name := range names {
+		if name == "" || name == "bb" || strings.Contains(name, "/") {
+			return fmt.Errorf("invalid command name %q", name)
+		}
+		if i > 0 && names[i-1] == name {
+			return fmt.Errorf("duplicate command name %q", name)
+		}
+	}
+
+	tw := tar.NewWriter(w)
+	hdr := func(name string, typ byte, mode int64) *tar.Header {
+		return &tar.Header{
+			Typeflag: typ,
+			Name:     name,
+			Mode:     mode,
+			ModTime:  time.Unix(0, 0),
+			Format:   tar.FormatUSTAR,
+		}
+	}
+	dir = strings.Trim(path.Clean(dir), "/")
+	if dir != "." {
+		if err := tw.WriteHeader(hdr(dir+"/", tar.TypeDir, 0755)); err != nil {
+			return err
+		}
+	}
+	bbHdr := hdr(path.Join(dir, "bb"), tar.TypeReg, 0755)
+	bbHdr.Size = fi.Size()
+	if err := tw.WriteHeader(bbHdr); err != nil {
+		return err
+	}
+	if _, err := io.Copy(tw, bb); err != nil {
+		return err
+	}
+	for _, name := range names {
+		link := hdr(path.Join(dir, name), tar.TypeSymlink, 0777)
+		link.Linkname = "bb"
+		if err := tw.WriteHeader(link); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func main() {
+	flag.Parse()
+	if *bbPath == "" || *out == "" {
+		log.Fatal("makebbtar: -bb and -o are required")
+	}
+
+	bb, err := os.Open(*bbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer bb.Close()
+
+	f, err := os.Create(*out)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := writeTar(f, bb, *dir, commands); err != nil {
+		f.Close()
+		log.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWriteTar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-makebbtar-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bbPath := filepath.Join(dir, "bb")
+	if err := ioutil.WriteFile(bbPath, []byte("busybox"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(names ...string) ([]byte, error) {
+		bb, err := os.Open(bbPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer bb.Close()
+		var b bytes.Buffer
+		err = writeTar(&b, bb, "bbin", names)
+		return b.Bytes(), err
+	}
+
+	b, err := write("ls", "cat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	type entry struct {
+		name, link string
+		typ        byte
+		content    string
+	}
+	var got []entry
+	tr := tar.NewReader(bytes.NewReader(b))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.ModTime.Unix() != 0 {
+			t.Errorf("%s has modification time %v, want the epoch", hdr.Name, hdr.ModTime)
+		}
+		got = append(got, entry{hdr.Name, hdr.Linkname, hdr.Typeflag, string(content)})
+	}
+	want := []entry{
+		{name: "bbin/", typ: tar.TypeDir},
+		{name: "bbin/bb", typ: tar.TypeReg, content: "busybox"},
+		{name: "bbin/cat", link: "bb", typ: tar.TypeSymlink},
+		{name: "bbin/ls", link: "bb", typ: tar.TypeSymlink},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("writeTar = %v, want %v", got, want)
+	}
+
+	// The archive does not depend on the order of commands.
+	if b2, err := write("cat", "ls"); err != nil || !bytes.Equal(b, b2) {
+		t.Errorf("writeTar is not reproducible: %v", err)
+	}
+
+	for _, names := range [][]string{{"bb"}, {"ls", "ls"}, {"a/b"}, {""}} {
+		if _, err := write(names...); err == nil {
+			t.Errorf("writeTar(%q) = nil, want error", names)
+		}
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"io/ioutil"
 	"log"
 	"path/filepath"
+	"strings"
 
 	"github.com/u-root/gobusybox/src/pkg/bb"
 	"github.com/u-root/gobusybox/src/pkg/monoimporter"
@@ -22,17 +23,35 @@ var (
 	name          = flag.String("name", "", "Name of the command")
 	pkg           = flag.String("package", "", "Go import package path")
 	destDir       = flag.String("dest_dir", "", "Destination directory")
+	goos          = flag.String("goos", "", "override GOOS of the resulting busybox")
 	goarch        = flag.String("goarch", "", "override GOARCH of the resulting busybox")
 	installSuffix = flag.String("install_suffix", "", "override installsuffix of the resulting busybox")
+	tags          = flag.String("tags", "", "Comma-separated build tags to select source files with")
+	releaseTags   = flag.String("release_tags", "", "Comma-separated release tags (go1.1, go1.2, ...) of the Go version the busybox is built with, overriding those of the Go version rewritepkg was built with")
+	cgo           = flag.Bool("cgo", build.Default.CgoEnabled, "Whether cgo is enabled for the resulting busybox")
+	interceptExit = flag.Bool("intercept_exit", false, "Route exits of the command through the busybox exit hooks")
 	gorootDir     uflag.Strings
 	archives      uflag.Strings
 	sourceFiles   uflag.Strings
+	importMap     uflag.Strings
 )
 
 func init() {
 	flag.Var(&gorootDir, "go_root_zip", "Go standard library zip archives containing stdlib object files")
 	flag.Var(&archives, "archive", "Archives")
 	flag.Var(&sourceFiles, "source", "Source files")
+	flag.Var(&importMap, "importmap", "path=file pairs of export data files to use for a package path or import path, in preference to searching archives")
+}
+
+// splitList splits a comma-separated list, dropping empty elements.
+func splitList(s string) []string {
+	var l []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			l = append(l, e)
+		}
+	}
+	return l
 }
 
 func main() {
@@ -43,9 +62,17 @@ func main() {
 	}
 
 	c := build.Default
+	if *goos != "" {
+		c.GOOS = *goos
+	}
 	if *goarch != "" {
 		c.GOARCH = *goarch
 	}
+	c.CgoEnabled = *cgo
+	c.BuildTags = splitList(*tags)
+	if *releaseTags != "" {
+		c.ReleaseTags = splitList(*releaseTags)
+	}
 	if *installSuffix != "" {
 		c.InstallSuffix = *installSuffix
 	}
@@ -53,10 +80,8 @@ func main() {
 	var gofiles []string
 	for _, path := range sourceFiles {
 		dir, basename := filepath.Split(path)
-		// Check the file against build tags.
-		//
-		// TODO: build.Default may not be the actual build environment.
-		// Fix it via flags from Skylark?
+		// Check the file against the build configuration, as given
+		// by the flags.
 		ok, err := c.MatchFile(dir, basename)
 		if ok {
 			gofiles = append(gofiles, path)
@@ -82,6 +107,11 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	exports, err := monoimporter.ParseImportMap([]string(importMap))
+	if err != nil {
+		log.Fatal(err)
+	}
+	imp.AddExports(exports)
 
 	p, err := monoimporter.Load(*pkg, gofiles, imp)
 	if err != nil {
@@ -89,6 +119,7 @@ func main() {
 	}
 
 	bbPkg := bb.NewPackage(*name, p)
+	bbPkg.InterceptExit = *interceptExit
 	if err := bbPkg.Rewrite(*destDir); err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,266 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/u-root/gobusybox/src/pkg/bb"
+	"github.com/u-root/gobusybox/src/pkg/golang"
+	"github.com/u-root/gobusybox/src/pkg/monoimporter"
+)
+
+// testModule is a module with a command whose rewrite depends on complete
+// type information: variable initialization order, identifiers used in
+// function bodies, and method selections.
+var testModule = map[string]string{
+	"go.mod": "module example.com/m\n\ngo 1.18\n",
+	"greet/greet.go": `package greet
+
+type Greeter struct{ Name string }
+
+func (g Greeter) Greet() string { return "hello " + g.Name }
+`,
+	"cmd/hello/main.go": `package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"example.com/m/greet"
+)
+
+var (
+	a = b + 1
+	b = len(g.Greet())
+	g = greet.Greeter{Name: os.Getenv("NAME")}
+)
+
+var logger = log.New(os.Stderr, "", 0)
+
+func main() {
+	if a < 0 {
+		logger.Fatalf("a = %d", a)
+	}
+	fmt.Println(g.Greet(), a, b)
+	os.Exit(0)
+}
+`,
+	"cmd/hello/init.go": `package main
+
+import "fmt"
+
+var c = fmt.Sprint(a)
+
+func init() {
+	c += "!"
+}
+`,
+}
+
+func readDir(t *testing.T, dir string) map[string][]byte {
+	t.Helper()
+	files := make(map[string][]byte)
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range fis {
+		b, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[fi.Name()] = b
+	}
+	return files
+}
+
+// TestRewriteMatchesGoPackages checks that rewriting a command with
+// rewritepkg, as Bazel does, produces the same source as rewriting it after
+// loading it with go/packages, as makebb does.
+func TestRewriteMatchesGoPackages(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+	dir, err := ioutil.TempDir("", "test-rewritepkg-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rewritepkg := filepath.Join(dir, "rewritepkg")
+	if b, err := exec.Command("go", "build", "-o", rewritepkg, ".").CombinedOutput(); err != nil {
+		t.Fatalf("go build: %v\n%s", err, b)
+	}
+
+	modDir := filepath.Join(dir, "m")
+	for name, content := range testModule {
+		path := filepath.Join(modDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	os.Setenv("GOPROXY", "off")
+	env := golang.Default()
+	env.GO111MODULE = "on"
+	exports, err := monoimporter.ExportsFromGoList(env, modDir, "./cmd/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, interceptExit := range []bool{false, true} {
+		// The makebb path, loading with go/packages.
+		pkgs, err := bb.NewPackages(env, filepath.Join(modDir, "cmd/hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pkgs) != 1 {
+			t.Fatalf("NewPackages(cmd/hello) = %v, want one package", pkgs)
+		}
+		p := pkgs[0]
+		p.InterceptExit = interceptExit
+		wantDir := filepath.Join(dir, "want")
+		if err := p.Rewrite(wantDir); err != nil {
+			t.Fatal(err)
+		}
+
+		// The Bazel path.
+		gotDir := filepath.Join(dir, "got")
+		if err := os.MkdirAll(gotDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		args := []string{
+			"-name", "hello",
+			"-package", "example.com/m/cmd/hello",
+			"-dest_dir", gotDir,
+			"-source", filepath.Join(modDir, "cmd/hello/init.go"),
+			"-source", filepath.Join(modDir, "cmd/hello/main.go"),
+		}
+		if interceptExit {
+			args = append(args, "-intercept_exit")
+		}
+		var importMap []string
+		for importPath, file := range exports {
+			importMap = append(importMap, importPath+"="+file)
+		}
+		sort.Strings(importMap)
+		for _, entry := range importMap {
+			args = append(args, "-importmap", entry)
+		}
+		if b, err := exec.Command(rewritepkg, args...).CombinedOutput(); err != nil {
+			t.Fatalf("rewritepkg: %v\n%s", err, b)
+		}
+
+		want, got := readDir(t, wantDir), readDir(t, gotDir)
+		if len(got) != len(want) {
+			t.Errorf("InterceptExit=%t: rewritepkg wrote %d files, want %d", interceptExit, len(got), len(want))
+		}
+		for name, w := range want {
+			if g := got[name]; !bytes.Equal(g, w) {
+				t.Errorf("InterceptExit=%t: rewritepkg wrote %s:\n%s\nwant:\n%s", interceptExit, name, g, w)
+			}
+		}
+		if !bytes.Contains(want["main.go"], []byte("a = b + 1")) {
+			t.Errorf("InterceptExit=%t: rewritten main.go has no variable initializers:\n%s", interceptExit, want["main.go"])
+		}
+
+		os.RemoveAll(wantDir)
+		os.RemoveAll(gotDir)
+	}
+}
+
+// TestFileSelection checks that source files are selected by the build
+// configuration given by flags. Excluded files are copied unchanged.
+func TestFileSelection(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+	dir, err := ioutil.TempDir("", "test-rewritepkg-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rewritepkg := filepath.Join(dir, "rewritepkg")
+	if b, err := exec.Command("go", "build", "-o", rewritepkg, ".").CombinedOutput(); err != nil {
+		t.Fatalf("go build: %v\n%s", err, b)
+	}
+
+	// Each file but main.go has a variable initializer, which the rewrite
+	// moves out of files it includes.
+	files := map[string]string{
+		"main.go":         "package main\n\nfunc main() {}\n",
+		"os_linux.go":     "package main\n\nvar linux = len(\"linux\")\n",
+		"os_windows.go":   "package main\n\nvar windows = len(\"windows\")\n",
+		"tagged.go":       "//go:build foo\n\npackage main\n\nvar foo = len(\"foo\")\n",
+		"cgo.go":          "//go:build cgo\n\npackage main\n\nvar withCgo = len(\"cgo\")\n",
+		"nocgo.go":        "//go:build !cgo\n\npackage main\n\nvar noCgo = len(\"nocgo\")\n",
+		"release.go":      "//go:build !go1.5\n\npackage main\n\nvar old = len(\"go1.4\")\n",
+		"arch_arm64.go":   "package main\n\nvar arm64 = len(\"arm64\")\n",
+		"arch_riscv64.go": "package main\n\nvar riscv64 = len(\"riscv64\")\n",
+	}
+	srcDir := filepath.Join(dir, "src")
+	if err := os.MkdirAll(srcDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	var sources []string
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(srcDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		sources = append(sources, "-source", filepath.Join(srcDir, name))
+	}
+
+	for _, tt := range []struct {
+		flags []string
+		want  []string
+	}{
+		{
+			flags: []string{"-goos", "linux", "-goarch", "arm64", "-cgo=false"},
+			want:  []string{"arch_arm64.go", "main.go", "nocgo.go", "os_linux.go"},
+		},
+		{
+			flags: []string{"-goos", "windows", "-goarch", "riscv64", "-cgo", "-tags", "bar,foo"},
+			want:  []string{"arch_riscv64.go", "cgo.go", "main.go", "os_windows.go", "tagged.go"},
+		},
+		{
+			flags: []string{"-goos", "linux", "-goarch", "arm64", "-cgo=false", "-release_tags", "go1.1,go1.2,go1.3,go1.4"},
+			want:  []string{"arch_arm64.go", "main.go", "nocgo.go", "os_linux.go", "release.go"},
+		},
+	} {
+		destDir := filepath.Join(dir, "out")
+		if err := os.MkdirAll(destDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		args := append([]string{"-name", "sel", "-package", "example.com/sel", "-dest_dir", destDir}, tt.flags...)
+		if b, err := exec.Command(rewritepkg, append(args, sources...)...).CombinedOutput(); err != nil {
+			t.Fatalf("rewritepkg %v: %v\n%s", tt.flags, err, b)
+		}
+
+		var got []string
+		for name, content := range readDir(t, destDir) {
+			if name == "main.go" || string(content) != files[name] {
+				got = append(got, name)
+			}
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("rewritepkg %v rewrote %v, want %v", tt.flags, got, tt.want)
+		}
+		os.RemoveAll(destDir)
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package busybox is a Gazelle language extension that generates busybox
+// targets for Go commands.
+//
+// It must be listed after the Go extension in gazelle_binary's languages. It
+// understands these directives:
+//
+//	# gazelle:busybox_library on|off
+//
+// In this directory and below, the go_library of every `package main`
+// directory is generated as go_busybox_library, so that its go_binary still
+// works and it can be part of a busybox, e.g. as //cmd/ls:ls_lib. Libraries of
+// other packages are left alone. Defaults to off.
+//
+//	# gazelle:busybox_binary NAME
+//
+// In this directory only, a go_busybox_binary NAME is generated with all
+// go_busybox_library commands in this directory and below.
+//
+//	# gazelle:busybox_bzl LABEL
+//
+// The label of build.bzl, which the generated rules are loaded from. Defaults
+// to //:build.bzl.
+package busybox
+
+import (
+	"flag"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bazelbuild/bazel-gazelle/config"
+	"github.com/bazelbuild/bazel-gazelle/label"
+	"github.com/bazelbuild/bazel-gazelle/language"
+	"github.com/bazelbuild/bazel-gazelle/repo"
+	"github.com/bazelbuild/bazel-gazelle/resolve"
+	"github.com/bazelbuild/bazel-gazelle/rule"
+)
+
+const (
+	libraryKind = "go_busybox_library"
+	binaryKind  = "go_busybox_binary"
+
+	libraryDirective = "busybox_library"
+	binaryDirective  = "busybox_binary"
+	bzlDirective     = "busybox_bzl"
+
+	defaultBzl = "//:build.bzl"
+)
+
+// busyboxConfig is the configuration of a directory.
+type busyboxConfig struct {
+	// library is set if command libraries are go_busybox_library.
+	library bool
+
+	// binary is the name of the go_busybox_binary to generate in the
+	// directory, if any. It is not inherited.
+	binary string
+
+	// bzl is the label of build.bzl.
+	bzl string
+}
+
+func getConfig(c *config.Config) *busyboxConfig {
+	if bc, ok := c.Exts[libraryDirective].(*busyboxConfig); ok {
+		return bc
+	}
+	return &busyboxConfig{bzl: defaultBzl}
+}
+
+type busyboxLang struct {
+	// commands are the labels of go_busybox_library commands generated so
+	// far, by directory. Gazelle generates rules of subdirectories first.
+	commands map[string]string
+}
+
+// NewLanguage returns the busybox Gazelle extension.
+func NewLanguage() language.Language {
+	return &busyboxLang{commands: make(map[string]string)}
+}
+
+// Name implements resolve.Resolver.Name.
+func (*busyboxLang) Name() string { return "busybox" }
+
+// RegisterFlags implements config.Configurer.RegisterFlags.
+func (*busyboxLang) RegisterFlags(fs *flag.FlagSet, cmd string, c *config.Config) {}
+
+// CheckFlags implements config.Configurer.CheckFlags.
+func (*busyboxLang) CheckFlags(fs *flag.FlagSet, c *config.Config) error { return nil }
+
+// KnownDirectives implements config.Configurer.KnownDirectives.
+func (*busyboxLang) KnownDirectives() []string {
+	return []string{libraryDirective, binaryDirective, bzlDirective}
+}
+
+// Configure implements config.Configurer.Configure.
+func (*busyboxLang) Configure(c *config.Config, rel string, f *rule.File) {
+	bc := *getConfig(c)
+	bc.binary = ""
+	if f != nil {
+		for _, d := range f.Directives {
+			switch d.Key {
+			case libraryDirective:
+				bc.library = d.Value == "on"
+			case binaryDirective:
+				bc.binary = d.Value
+			case bzlDirective:
+				bc.bzl = d.Value
+			}
+		}
+	}
+	c.Exts[libraryDirective] = &bc
+
+	// The kinds are loaded from bc.bzl, which Loads cannot know. Mapping
+	// them to themselves makes Gazelle load them from there, unless they
+	// are mapped to other kinds with the map_kind directive.
+	for _, kind := range []string{libraryKind, binaryKind} {
+		if m, ok := c.KindMap[kind]; !ok || m.KindName == kind {
+			c.KindMap[kind] = config.MappedKind{
+				FromKind: kind,
+				KindName: kind,
+				KindLoad: bc.bzl,
+			}
+		}
+	}
+
+	// Go libraries of commands are generated by the Go extension, and
+	// mapped to go_busybox_library like with the map_kind directive, so
+	// that the go_binary embedding them keeps working.
+	if m, ok := c.KindMap["go_library"]; ok && m.KindName == libraryKind {
+		delete(c.KindMap, "go_library")
+	}
+	if bc.library && isCommandDir(filepath.Join(c.RepoRoot, filepath.FromSlash(rel))) {
+		c.KindMap["go_library"] = config.MappedKind{
+			FromKind: "go_library",
+			KindName: libraryKind,
+			KindLoad: bc.bzl,
+		}
+	}
+}
+
+// isCommandDir returns true if the Go files in dir, other than tests, are
+// package main.
+func isCommandDir(dir string) bool {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	fset := token.NewFileSet()
+	for _, fi := range fis {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, filepath.Join(dir, name), nil, parser.PackageClauseOnly)
+		if err != nil {
+			continue
+		}
+		if f.Name.Name == "main" {
+			return true
+		}
+	}
+	return false
+}
+
+// Kinds implements language.Language.Kinds.
+func (*busyboxLang) Kinds() map[string]rule.KindInfo {
+	return map[string]rule.KindInfo{
+		libraryKind: {
+			NonEmptyAttrs:  map[string]bool{"srcs": true},
+			MergeableAttrs: map[string]bool{"importpath": true, "srcs": true},
+			ResolveAttrs:   map[string]bool{"deps": true},
+		},
+		binaryKind: {
+			NonEmptyAttrs:  map[string]bool{"commands": true},
+			MergeableAttrs: map[string]bool{"commands": true},
+		},
+	}
+}
+
+// Loads implements language.Language.Loads. The kinds are loaded from the
+// busybox_bzl label through kind mappings set by Configure instead.
+func (*busyboxLang) Loads() []rule.LoadInfo { return nil }
+
+// ApparentLoads implements language.ModuleAwareLanguage.ApparentLoads. Like
+// Loads, it returns nothing.
+func (*busyboxLang) ApparentLoads(moduleToApparentName func(string) string) []rule.LoadInfo {
+	return nil
+}
+
+// GenerateRules implements language.Language.GenerateRules.
+//
+// It records the command library generated by the Go extension in
+// args.OtherGen, and generates a go_busybox_binary of the commands recorded
+// in this directory and below if asked to.
+func (l *busyboxLang) GenerateRules(args language.GenerateArgs) language.GenerateResult {
+	bc := getConfig(args.Config)
+	if bc.library && isCommandDir(args.Dir) {
+		for _, r := range args.OtherGen {
+			if r.Kind() == "go_library" || r.Kind() == libraryKind {
+				l.commands[args.Rel] = label.New("", args.Rel, r.Name()).String()
+			}
+		}
+	}
+
+	var res language.GenerateResult
+	if bc.binary == "" {
+		return res
+	}
+	var commands []string
+	for rel, cmd := range l.commands {
+		if args.Rel == "" || rel == args.Rel || strings.HasPrefix(rel, args.Rel+"/") {
+			commands = append(commands, cmd)
+		}
+	}
+	sort.Strings(commands)
+	r := rule.NewRule(binaryKind, bc.binary)
+	r.SetAttr("commands", commands)
+	res.Gen = append(res.Gen, r)
+	res.Imports = append(res.Imports, nil)
+	return res
+}
+
+// Fix implements language.Language.Fix.
+func (*busyboxLang) Fix(c *config.Config, f *rule.File) {}
+
+// Imports implements resolve.Resolver.Imports. The Go extension indexes
+// command libraries.
+func (*busyboxLang) Imports(c *config.Config, r *rule.Rule, f *rule.File) []resolve.ImportSpec {
+	return nil
+}
+
+// Embeds implements resolve.Resolver.Embeds.
+func (*busyboxLang) Embeds(r *rule.Rule, from label.Label) []label.Label { return nil }
+
+// Resolve implements resolve.Resolver.Resolve. Commands of go_busybox_binary
+// are labels already.
+func (*busyboxLang) Resolve(c *config.Config, ix *resolve.RuleIndex, rc *repo.RemoteCache, r *rule.Rule, imports interface{}, from label.Label) {
+}
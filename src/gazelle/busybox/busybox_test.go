@@ -0,0 +1,128 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package busybox
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/bazelbuild/bazel-gazelle/config"
+	"github.com/bazelbuild/bazel-gazelle/language"
+	"github.com/bazelbuild/bazel-gazelle/rule"
+)
+
+func TestGenerateRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-busybox-gazelle-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, content := range map[string]string{
+		"cmd/ls/ls.go":           "package main\n",
+		"cmd/ls/ls_test.go":      "package main\n",
+		"cmd/ip/ip.go":           "package main\n",
+		"cmd/internal/util.go":   "package util\n",
+		"cmd/internal/x_test.go": "package main\n",
+		"tools/gen/gen.go":       "package main\n",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	l := NewLanguage()
+	root := &config.Config{
+		RepoRoot: dir,
+		Exts:     make(map[string]interface{}),
+		KindMap:  make(map[string]config.MappedKind),
+	}
+	configure := func(parent *config.Config, rel string, directives ...rule.Directive) *config.Config {
+		c := *parent
+		c.Exts = make(map[string]interface{})
+		for k, v := range parent.Exts {
+			c.Exts[k] = v
+		}
+		c.KindMap = make(map[string]config.MappedKind)
+		for k, v := range parent.KindMap {
+			c.KindMap[k] = v
+		}
+		l.Configure(&c, rel, &rule.File{Directives: directives})
+		return &c
+	}
+	generate := func(c *config.Config, rel string, libName string) language.GenerateResult {
+		var gen []*rule.Rule
+		if libName != "" {
+			gen = append(gen, rule.NewRule("go_library", libName))
+		}
+		return l.GenerateRules(language.GenerateArgs{
+			Config:   c,
+			Dir:      filepath.Join(dir, filepath.FromSlash(rel)),
+			Rel:      rel,
+			OtherGen: gen,
+		})
+	}
+
+	rootC := configure(root, "", rule.Directive{Key: "busybox_binary", Value: "bb"})
+	cmdC := configure(rootC, "cmd",
+		rule.Directive{Key: "busybox_library", Value: "on"},
+		rule.Directive{Key: "busybox_bzl", Value: "@gobusybox//:build.bzl"},
+	)
+	for _, tt := range []struct {
+		c    *config.Config
+		kind string
+		want string
+	}{
+		{c: rootC, kind: "go_busybox_binary", want: "//:build.bzl"},
+		{c: cmdC, kind: "go_busybox_binary", want: "@gobusybox//:build.bzl"},
+		{c: cmdC, kind: "go_busybox_library", want: "@gobusybox//:build.bzl"},
+	} {
+		if m := tt.c.KindMap[tt.kind]; m.KindName != tt.kind || m.KindLoad != tt.want {
+			t.Errorf("%s is mapped to %v, want it loaded from %s", tt.kind, m, tt.want)
+		}
+	}
+	for _, tt := range []struct {
+		parent *config.Config
+		rel    string
+		lib    string
+		mapped bool
+	}{
+		{parent: cmdC, rel: "cmd/ls", lib: "ls_lib", mapped: true},
+		{parent: cmdC, rel: "cmd/ip", lib: "ip_lib", mapped: true},
+		{parent: cmdC, rel: "cmd/internal", lib: "util"},
+		// busybox_library is off outside cmd.
+		{parent: rootC, rel: "tools/gen", lib: "gen_lib"},
+	} {
+		c := configure(tt.parent, tt.rel)
+		if m, ok := c.KindMap["go_library"]; ok != tt.mapped || (ok && (m.KindName != "go_busybox_library" || m.KindLoad != "@gobusybox//:build.bzl")) {
+			t.Errorf("%s: go_library is mapped to %v, want mapped %t", tt.rel, m, tt.mapped)
+		}
+		if res := generate(c, tt.rel, tt.lib); len(res.Gen) != 0 {
+			t.Errorf("%s: generated %d rules, want none", tt.rel, len(res.Gen))
+		}
+	}
+	if res := generate(cmdC, "cmd", ""); len(res.Gen) != 0 {
+		t.Errorf("cmd: generated %d rules, want none", len(res.Gen))
+	}
+
+	res := generate(rootC, "", "")
+	if len(res.Gen) != 1 || len(res.Imports) != 1 {
+		t.Fatalf("generated %d rules, want 1", len(res.Gen))
+	}
+	r := res.Gen[0]
+	if r.Kind() != "go_busybox_binary" || r.Name() != "bb" {
+		t.Errorf("generated %s %s, want go_busybox_binary bb", r.Kind(), r.Name())
+	}
+	want := []string{"//cmd/ip:ip_lib", "//cmd/ls:ls_lib"}
+	if got := r.AttrStrings("commands"); !reflect.DeepEqual(got, want) {
+		t.Errorf("go_busybox_binary commands = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,12 @@
+module github.com/u-root/gobusybox/src/gazelle
+
+go 1.22.9
+
+require github.com/bazelbuild/bazel-gazelle v0.45.0
+
+require (
+	github.com/bazelbuild/buildtools v0.0.0-20240918101019-be1c24cc9a44 // indirect
+	golang.org/x/mod v0.20.0 // indirect
+	golang.org/x/sys v0.28.0 // indirect
+	golang.org/x/tools/go/vcs v0.1.0-deprecated // indirect
+)
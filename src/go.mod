@@ -1,10 +1,15 @@
 module github.com/u-root/gobusybox/src
 
-go 1.13
+go 1.25.0
 
 require (
 	github.com/google/goterm v0.0.0-20200907032337-555d40f16ae2
 	github.com/u-root/u-root v7.0.0+incompatible
-	golang.org/x/sys v0.0.0-20200323222414-85ca7c5b95cd
-	golang.org/x/tools v0.0.0-20200904185747-39188db58858
+	golang.org/x/sys v0.43.0
+	golang.org/x/tools v0.44.0
+)
+
+require (
+	golang.org/x/mod v0.35.0 // indirect
+	golang.org/x/sync v0.20.0 // indirect
 )
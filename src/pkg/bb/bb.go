@@ -12,7 +12,9 @@
 // `argv[0]` is not recognized.
 //
 // Under the hood, bb implements a Go source-to-source transformation on pure
-// Go code. This AST transformation does the following:
+// Go code, or on the original (not cgo-processed) source files of cgo
+// commands if cgo is enabled in the build environment. This AST
+// transformation does the following:
 //
 //   - Takes a Go command's source files and rewrites them into Go package files
 //     without global side effects.
@@ -26,20 +28,28 @@ package bb
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"go/ast"
+	"go/build/constraint"
+	"go/doc"
 	"go/format"
+	"go/parser"
 	"go/token"
 	"go/types"
+	"go/version"
 	"io/ioutil"
-	"log"
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
 
-	"github.com/google/goterm/term"
 	"golang.org/x/tools/go/ast/astutil"
 	"golang.org/x/tools/go/packages"
 	"golang.org/x/tools/imports"
@@ -48,30 +58,132 @@ import (
 	"github.com/u-root/u-root/pkg/cp"
 )
 
-func checkDuplicate(cmds []string) error {
-	seen := make(map[string]struct{})
+func checkDuplicate(cmds []*Package) error {
+	seen := make(map[string]string)
 	for _, cmd := range cmds {
-		name := path.Base(cmd)
-		if _, ok := seen[name]; ok {
-			return fmt.Errorf("failed to build with bb: found duplicate command %s", name)
+		if pkgPath, ok := seen[cmd.Name]; ok {
+			return &DuplicateCommandError{
+				Name:         cmd.Name,
+				PkgPath:      pkgPath,
+				OtherPkgPath: cmd.Pkg.PkgPath,
+			}
 		}
-		seen[name] = struct{}{}
+		seen[cmd.Name] = cmd.Pkg.PkgPath
 	}
 	return nil
 }
 
+// Opts are the arguments to BuildBusyboxWithOpts.
+type Opts struct {
+	// Env is the Go build environment.
+	Env golang.Environ
+
+	// CommandPaths is a list of file system directories or Go import
+	// paths of the commands to compile into the busybox.
+	CommandPaths []string
+
+	// BinaryPath is the file to write the busybox binary to.
+	BinaryPath string
+
+	// NoStrip builds an unstripped binary.
+	NoStrip bool
+
+	// Jobs is the maximum number of modules loaded or commands rewritten
+	// concurrently. If 0, runtime.NumCPU() is used.
+	Jobs int
+
+	// Logger receives log messages, including how long each phase of the
+	// build takes at LevelDebug. If nil, messages are discarded.
+	Logger Logger
+
+	// Progress, if not nil, is called as the build progresses. Calls are
+	// never concurrent.
+	Progress func(Event)
+
+	// OptionalCommandPaths are like CommandPaths, but packages that fail
+	// to load or are not commands are skipped with a warning.
+	OptionalCommandPaths []string
+
+	// KeepGoing skips all packages that fail to load or are not commands
+	// with a warning. Otherwise, paths of CommandPaths that yield no
+	// command or fail to load fail the build with a SkippedPackagesError.
+	KeepGoing bool
+
+	// InterceptExit rewrites commands with Package.InterceptExit, so that
+	// exits of commands run the exit hooks of the busybox.
+	InterceptExit bool
+
+	// ExitPanics makes intercepted exits panic until they reach the
+	// busybox's Run, so that deferred functions of commands run. Implies
+	// InterceptExit.
+	ExitPanics bool
+
+	// DefaultCommand is the name of the command run if neither argv[0]
+	// nor argv[1] name a command. If empty, the busybox fails instead.
+	DefaultCommand string
+
+	// Aliases map additional names to the names of commands they run.
+	Aliases map[string]string
+
+	// Template is the directory of the busybox's main package, which
+	// registers and dispatches the commands as documented by
+	// CreateBBMainSourceWithOpts. Its Go files other than tests that
+	// Env's build constraints select are used. If empty, the bbmain/cmd
+	// template is used.
+	Template string
+}
+
 // BuildBusybox builds a busybox of the given Go packages.
 //
-// pkgs is a list of Go import paths. If nil is returned, binaryPath will hold
-// the busybox-style binary.
-func BuildBusybox(env golang.Environ, cmdPaths []string, noStrip bool, binaryPath string) (nerr error) {
+// cmdPaths is a list of file system directories or Go import paths. If nil is
+// returned, binaryPath will hold the busybox-style binary.
+//
+// BuildBusybox is BuildBusyboxWithOpts with default options.
+func BuildBusybox(env golang.Environ, cmdPaths []string, noStrip bool, binaryPath string) error {
+	return BuildBusyboxWithOpts(&Opts{
+		Env:          env,
+		CommandPaths: cmdPaths,
+		NoStrip:      noStrip,
+		BinaryPath:   binaryPath,
+	})
+}
+
+// BuildBusyboxWithOpts builds a busybox of the commands in opts.
+//
+// If nil is returned, opts.BinaryPath will hold the busybox-style binary.
+//
+// Errors that callers may want to act on are of the types
+// ModuleConflictErrors, DuplicateCommandError, RewriteError,
+// SkippedPackagesError and LoadError, and can be found with errors.As.
+func BuildBusyboxWithOpts(opts *Opts) error {
+	return BuildBusyboxContext(context.Background(), opts)
+}
+
+// BuildBusyboxContext is like BuildBusyboxWithOpts, but aborts the build once
+// ctx is done. Package loading and `go build` are killed, and no more files are
+// written.
+//
+// The error of an aborted build matches ctx.Err() with errors.Is. Unlike
+// other failed builds, aborted builds do not preserve their temporary
+// directory: it is removed before BuildBusyboxContext returns.
+func BuildBusyboxContext(ctx context.Context, opts *Opts) (nerr error) {
+	env := opts.Env
+	r := newReporter(opts)
+	l := r.l
 	tmpDir, err := ioutil.TempDir("", "bb-")
 	if err != nil {
 		return err
 	}
 	defer func() {
-		if nerr != nil {
-			log.Printf("Preserving bb temporary directory at %s due to error", tmpDir)
+		if ctxErr := ctx.Err(); ctxErr != nil && nerr != nil {
+			// The go command's own errors do not always wrap ctx.Err().
+			if !errors.Is(nerr, ctxErr) {
+				nerr = fmt.Errorf("%v: %w", nerr, ctxErr)
+			}
+			// Everything that writes to tmpDir has returned by now.
+			os.RemoveAll(tmpDir)
+		} else if nerr != nil {
+			l.Logf(LevelInfo, "Preserving bb temporary directory at %s due to error", tmpDir)
 		} else {
 			os.RemoveAll(tmpDir)
 		}
@@ -132,44 +244,88 @@ func BuildBusybox(env golang.Environ, cmdPaths []string, noStrip bool, binaryPat
 	}
 	pkgDir := filepath.Join(tmpDir, "src")
 
-	// Collect all packages that we need to actually re-write.
-	/*if err := checkDuplicate(cmdPaths); err != nil {
-		return err
-	}*/
-
-	// Ask go about all the commands in one batch for dependency caching.
-	cmds, err := NewPackages(env, cmdPaths...)
+	// Ask go about all the commands in one batch per module for
+	// dependency caching.
+	done := r.phase(PhaseLoad)
+	cmds, err := newPackages(ctx, r, env, opts.Jobs, !opts.KeepGoing, opts.CommandPaths...)
 	if err != nil {
-		return fmt.Errorf("finding packages failed: %v", err)
+		return fmt.Errorf("finding packages failed: %w", err)
+	}
+	if len(opts.OptionalCommandPaths) > 0 {
+		optionalCmds, err := newPackages(ctx, r, env, opts.Jobs, false, opts.OptionalCommandPaths...)
+		if err != nil {
+			return fmt.Errorf("finding optional packages failed: %w", err)
+		}
+		cmds = append(cmds, optionalCmds...)
 	}
 	if len(cmds) == 0 {
 		return fmt.Errorf("no commands compiled")
 	}
-
+	if err := checkDuplicate(cmds); err != nil {
+		return err
+	}
 	// List of packages to import in the real main file.
 	var bbImports []string
-	// Rewrite commands to packages.
 	for _, cmd := range cmds {
+		bbImports = append(bbImports, cmd.Pkg.PkgPath)
+	}
+	var names []string
+	for _, cmd := range cmds {
+		names = append(names, cmd.Name)
+	}
+	if err := checkNames(names, opts.Aliases, opts.DefaultCommand); err != nil {
+		return err
+	}
+	done()
+
+	// Rewrite commands to packages. Each command only touches its own
+	// syntax trees and destination directory.
+	done = r.phase(PhaseRewrite)
+	err = parallel(ctx, opts.Jobs, len(cmds), func(i int) error {
+		start := time.Now()
+		cmd := cmds[i]
+		cmd.InterceptExit = opts.InterceptExit || opts.ExitPanics
 		destination := filepath.Join(pkgDir, cmd.Pkg.PkgPath)
 
+		// cgo commands are rewritten from their original source files.
+		if usesCgo(cmd.Pkg) {
+			if err := parseGoFiles(cmd.Pkg); err != nil {
+				return &RewriteError{PkgPath: cmd.Pkg.PkgPath, Err: err}
+			}
+		}
 		if err := cmd.Rewrite(destination); err != nil {
-			return fmt.Errorf("rewriting command %q failed: %v", cmd.Pkg.PkgPath, err)
+			return err
 		}
-		bbImports = append(bbImports, cmd.Pkg.PkgPath)
+		r.command(PhaseRewrite, cmd.Pkg.PkgPath, start)
+		return nil
+	})
+	if err != nil {
+		return err
 	}
+	done()
 
-	if err := ioutil.WriteFile(filepath.Join(bbDir, "main.go"), bbMainSource, 0755); err != nil {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	template := bbMainTemplate
+	if opts.Template != "" {
+		if template, err = readTemplate(env.Context, opts.Template); err != nil {
+			return err
+		}
+	}
+	if err := writeTemplate(bbDir, template); err != nil {
 		return err
 	}
 
 	bbEnv := env
-	// main.go has no outside dependencies, and the go.mod file has not
+	// The template has no outside dependencies, and the go.mod file has not
 	// been written yet, so turn off Go modules.
 	//
 	// TODO(chrisko): just parse AST and fset manually here. It'll be
 	// shared code for this and bazel that way.
 	bbEnv.GO111MODULE = "off"
-	bb, err := NewPackages(bbEnv, bbDir)
+	// The bb package is not a command to report as loaded.
+	bb, err := newPackages(ctx, &reporter{l: l}, bbEnv, 0, false, bbDir)
 	if err != nil {
 		return err
 	}
@@ -178,15 +334,33 @@ func BuildBusybox(env golang.Environ, cmdPaths []string, noStrip bool, binaryPat
 	}
 
 	// Collect and write dependencies into pkgDir.
-	hasModules, err := dealWithDeps(env, tmpDir, pkgDir, cmds)
+	done = r.phase(PhaseDeps)
+	hasModules, err := dealWithDeps(ctx, env, tmpDir, pkgDir, cmds)
 	if err != nil {
-		return fmt.Errorf("dealing with deps: %v", err)
+		return fmt.Errorf("dealing with deps: %w", err)
 	}
+	done()
 
 	// Create bb main.go.
-	if err := CreateBBMainSource(bb[0].Pkg, bbImports, bbDir); err != nil {
+	done = r.phase(PhaseMain)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	mainOpts := &MainOpts{
+		InterceptExit: opts.InterceptExit || opts.ExitPanics,
+		ExitPanics:    opts.ExitPanics,
+
+		DefaultCommand: opts.DefaultCommand,
+		Aliases:        opts.Aliases,
+		Synopses:       make(map[string]string),
+	}
+	for _, cmd := range cmds {
+		mainOpts.Synopses[cmd.Name] = Synopsis(cmd.Pkg.Syntax)
+	}
+	if err := CreateBBMainSourceWithOpts(bb[0].Pkg, bbImports, bbDir, mainOpts); err != nil {
 		return fmt.Errorf("creating bb main() file failed: %v", err)
 	}
+	done()
 
 	// We do not support non-module compilation anymore, because the u-root
 	// dependencies need modules anyway. There's literally no way around
@@ -196,9 +370,11 @@ func BuildBusybox(env golang.Environ, cmdPaths []string, noStrip bool, binaryPat
 	if env.GO111MODULE == "off" || !hasModules {
 		env.GOPATH = tmpDir
 	}
-	if err := env.BuildDir(bbDir, binaryPath, golang.BuildOpts{NoStrip: noStrip}); err != nil {
+	done = r.phase(PhaseCompile)
+	if err := env.BuildDirContext(ctx, bbDir, opts.BinaryPath, golang.BuildOpts{NoStrip: opts.NoStrip}); err != nil {
 		return fmt.Errorf("go build: %v", err)
 	}
+	done()
 	return nil
 }
 
@@ -262,8 +438,11 @@ func localModules(pkgDir string, mainPkgs []*Package) ([]string, error) {
 				//
 				// This only looks for 2 conflicting *local* module definitions.
 				if original.m.Dir != module.Dir {
-					return nil, fmt.Errorf("two conflicting versions of module %s have been requested; one from %s, the other from %s's go.mod",
-						modPath, original.provenance, p.Pkg.Module.Path)
+					return nil, ModuleConflictErrors{{
+						ModulePath:      modPath,
+						Provenance:      fmt.Sprintf("%s uses %s", original.provenance, moduleIdentifier(original.m)),
+						OtherProvenance: fmt.Sprintf("%s's go.mod uses %s", p.Pkg.Module.Path, moduleIdentifier(module)),
+					}}
 				}
 			} else {
 				localModules[modPath] = &localModule{
@@ -281,30 +460,39 @@ func localModules(pkgDir string, mainPkgs []*Package) ([]string, error) {
 	// Look for conflicts between remote and local modules.
 	//
 	// E.g. if u-bmc depends on u-root, but we are also compiling u-root locally.
-	var conflict bool
+	var conflicts ModuleConflictErrors
+	seen := make(map[string]struct{})
 	for _, mainPkg := range mainPkgs {
 		packages.Visit([]*packages.Package{mainPkg.Pkg}, nil, func(p *packages.Package) {
 			if p.Module == nil {
 				return
 			}
-			if l, ok := localModules[p.Module.Path]; ok && l.m.Dir != p.Module.Dir {
-				fmt.Fprintln(os.Stderr, "")
-				log.Printf("Conflicting module dependencies on %s:", p.Module.Path)
-				log.Printf("  %s uses %s", mainPkg.Pkg.Module.Path, moduleIdentifier(p.Module))
-				log.Printf("  %s uses %s", l.provenance, moduleIdentifier(l.m))
-				replacePath, err := filepath.Rel(mainPkg.Pkg.Module.Dir, l.m.Dir)
-				if err != nil {
-					replacePath = l.m.Dir
-				}
-				fmt.Fprintln(os.Stderr, "")
-				log.Printf("%s: add `replace %s => %s` to %s", term.Bold("Suggestion to resolve"), p.Module.Path, replacePath, mainPkg.Pkg.Module.GoMod)
-				fmt.Fprintln(os.Stderr, "")
-				conflict = true
+			l, ok := localModules[p.Module.Path]
+			if !ok || l.m.Dir == p.Module.Dir {
+				return
+			}
+			// Report each conflict once, not once per package.
+			key := mainPkg.Pkg.Module.GoMod + " " + p.Module.Path
+			if _, ok := seen[key]; ok {
+				return
+			}
+			seen[key] = struct{}{}
+
+			replacePath, err := filepath.Rel(mainPkg.Pkg.Module.Dir, l.m.Dir)
+			if err != nil {
+				replacePath = l.m.Dir
 			}
+			conflicts = append(conflicts, &ModuleConflictError{
+				ModulePath:      p.Module.Path,
+				Provenance:      fmt.Sprintf("%s uses %s", mainPkg.Pkg.Module.Path, moduleIdentifier(p.Module)),
+				OtherProvenance: fmt.Sprintf("%s uses %s", l.provenance, moduleIdentifier(l.m)),
+				Replace:         fmt.Sprintf("replace %s => %s", p.Module.Path, replacePath),
+				GoMod:           mainPkg.Pkg.Module.GoMod,
+			})
 		})
 	}
-	if conflict {
-		return nil, fmt.Errorf("conflicting module dependencies found")
+	if len(conflicts) > 0 {
+		return nil, conflicts
 	}
 
 	var modules []string
@@ -318,13 +506,17 @@ func moduleIdentifier(m *packages.Module) string {
 	if m.Replace != nil && isReplacedModuleLocal(m.Replace) {
 		return fmt.Sprintf("directory %s", m.Replace.Path)
 	}
+	// Main modules have no version.
+	if m.Version == "" {
+		return fmt.Sprintf("directory %s", m.Dir)
+	}
 	return fmt.Sprintf("version %s", m.Version)
 }
 
 // dealWithDeps tries to suss out local files that need to be in the tree.
 //
 // It helps to have read https://golang.org/ref/mod when editing this function.
-func dealWithDeps(env golang.Environ, tmpDir, pkgDir string, mainPkgs []*Package) (bool, error) {
+func dealWithDeps(ctx context.Context, env golang.Environ, tmpDir, pkgDir string, mainPkgs []*Package) (bool, error) {
 	// Module-enabled Go programs resolve their dependencies in one of two ways:
 	//
 	// - locally, if the dependency is *in* the module or there is a local replace directive
@@ -393,6 +585,9 @@ func dealWithDeps(env golang.Environ, tmpDir, pkgDir string, mainPkgs []*Package
 	// tmpDir/src.
 	seenIDs := make(map[string]struct{})
 	for _, p := range localDepPkgs {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
 		if _, ok := seenIDs[p.ID]; !ok {
 			if err := writePkg(p, filepath.Join(pkgDir, p.PkgPath)); err != nil {
 				return false, fmt.Errorf("writing package %s failed: %v", p, err)
@@ -430,11 +625,12 @@ func dealWithDeps(env golang.Environ, tmpDir, pkgDir string, mainPkgs []*Package
 }
 
 // deps recursively iterates through imports and returns the set of packages
-// for which filter returns true.
+// other than p for which filter returns true.
 func deps(p *packages.Package, filter func(p *packages.Package) bool) []*packages.Package {
 	var pkgs []*packages.Package
 	packages.Visit([]*packages.Package{p}, nil, func(pkg *packages.Package) {
-		if filter(pkg) {
+		// p itself is written by Rewrite.
+		if pkg != p && filter(pkg) {
 			pkgs = append(pkgs, pkg)
 		}
 	})
@@ -490,16 +686,141 @@ func collectDeps(p *packages.Package, localModules []string) []*packages.Package
 
 // CreateBBMainSource creates a bb Go command that imports all given pkgs.
 //
-// p must be the bb template.
-//
-// - For each pkg in pkgs, add
-//     import _ "pkg"
-//   to astp's first file.
-// - Write source file out to destDir.
+// p must be the bb template; see CreateBBMainSourceWithOpts.
 func CreateBBMainSource(p *packages.Package, pkgs []string, destDir string) error {
-	if len(p.Syntax) != 1 {
-		return fmt.Errorf("bb cmd template is supposed to only have one file")
+	return CreateBBMainSourceWithOpts(p, pkgs, destDir, &MainOpts{})
+}
+
+// Synopsis returns the first sentence of the package documentation of a
+// command's files, to be used in MainOpts.Synopses.
+func Synopsis(files []*ast.File) string {
+	for _, f := range files {
+		if f.Doc != nil {
+			return doc.Synopsis(f.Doc.Text())
+		}
 	}
+	return ""
+}
+
+// checkNames returns an error if two commands or aliases have the same name,
+// an alias does not name a command, or defaultCmd is not empty and neither
+// the name of a command nor an alias.
+func checkNames(names []string, aliases map[string]string, defaultCmd string) error {
+	cmds := make(map[string]bool)
+	for _, name := range names {
+		if cmds[name] {
+			return fmt.Errorf("two commands are named %q", name)
+		}
+		cmds[name] = true
+	}
+
+	var sorted []string
+	for alias := range aliases {
+		sorted = append(sorted, alias)
+	}
+	sort.Strings(sorted)
+	for _, alias := range sorted {
+		switch name := aliases[alias]; {
+		case alias == "" || strings.Contains(alias, "/"):
+			return fmt.Errorf("invalid alias %q", alias)
+		case cmds[alias]:
+			return fmt.Errorf("alias %q is also the name of a command", alias)
+		case !cmds[name]:
+			return fmt.Errorf("alias %q is for %q, which is not one of the commands", alias, name)
+		}
+	}
+
+	if _, ok := aliases[defaultCmd]; defaultCmd != "" && !cmds[defaultCmd] && !ok {
+		return fmt.Errorf("default command %q is not one of the commands", defaultCmd)
+	}
+	return nil
+}
+
+// MainOpts are options for the generated busybox main.
+type MainOpts struct {
+	// InterceptExit must be set if the commands were rewritten with
+	// Package.InterceptExit. Their exits then call the template's Exit.
+	InterceptExit bool
+
+	// ExitPanics sets the template's ExitPanics.
+	ExitPanics bool
+
+	// DefaultCommand sets the template's DefaultCmd. It must be the name of
+	// one of the commands or aliases.
+	DefaultCommand string
+
+	// Names map package paths of commands to their names, overriding the
+	// default of the base name of the package path.
+	Names map[string]string
+
+	// Aliases map additional names to the names of commands they run.
+	Aliases map[string]string
+
+	// Synopses map command names to one-line descriptions, which the
+	// busybox's help command lists.
+	Synopses map[string]string
+}
+
+// commandName returns the name of the command with package path pkg.
+func (opts *MainOpts) commandName(pkg string) string {
+	if name, ok := opts.Names[pkg]; ok {
+		return name
+	}
+	return path.Base(pkg)
+}
+
+// mangledName returns a unique import name for the package of the command
+// name, which is not necessarily an identifier, and adds it to used.
+func mangledName(name string, used map[string]bool) string {
+	mangled := "mangled" + strings.Map(func(r rune) rune {
+		if r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return '_'
+	}, name)
+	base := mangled
+	for i := 2; used[mangled]; i++ {
+		mangled = fmt.Sprintf("%s_%d", base, i)
+	}
+	used[mangled] = true
+	return mangled
+}
+
+// CreateBBMainSourceWithOpts is like CreateBBMainSource, with options.
+//
+// The template p is a package main of any number of files, which only import
+// the standard library. Its files are written to destDir together with
+// RegisterFile, whose init function
+//
+//   - calls Register(name string, init, main func()) with the name and the
+//     Init and Main functions of each command package of pkgs, in order,
+//   - calls RegisterSynopsis(name, synopsis string) after Register for each
+//     command with a synopsis in opts.Synopses, if the template declares
+//     RegisterSynopsis,
+//   - sets each command package's BBExit to Exit, a func(code int), if
+//     opts.InterceptExit is set,
+//   - calls RegisterAlias(alias, name string) for each alias in
+//     opts.Aliases, sorted by alias, after all commands are registered,
+//   - sets ExitPanics, a bool, to true if opts.ExitPanics is set,
+//   - sets DefaultCmd, a string, to opts.DefaultCommand if it is not empty.
+//
+// Register is required; the other functions and variables only if the
+// options that use them are set. What the template does with the commands is
+// up to it: the default template in bbmain/cmd dispatches on argv[0] or
+// argv[1].
+func CreateBBMainSourceWithOpts(p *packages.Package, pkgs []string, destDir string, opts *MainOpts) error {
+	if err := checkTemplate(p.Fset, p.Syntax, opts); err != nil {
+		return err
+	}
+	var names []string
+	for _, pkg := range pkgs {
+		names = append(names, opts.commandName(pkg))
+	}
+	if err := checkNames(names, opts.Aliases, opts.DefaultCommand); err != nil {
+		return err
+	}
+	hasSynopses := declarations(p.Syntax).funcs["RegisterSynopsis"]
+	register := &ast.File{Name: ast.NewIdent("main")}
 
 	bbRegisterInit := &ast.FuncDecl{
 		Name: ast.NewIdent("init"),
@@ -509,12 +830,14 @@ func CreateBBMainSource(p *packages.Package, pkgs []string, destDir string) erro
 		},
 	}
 
-	for _, pkg := range pkgs {
-		name := path.Base(pkg)
+	mangledNames := make(map[string]bool)
+	for i, pkg := range pkgs {
+		name := names[i]
 		// import mangledpkg "pkg"
 		//
 		// A lot of package names conflict with code in main.go or Go keywords (e.g. init cmd)
-		astutil.AddNamedImport(p.Fset, p.Syntax[0], fmt.Sprintf("mangled%s", name), pkg)
+		mangled := mangledName(name, mangledNames)
+		astutil.AddNamedImport(p.Fset, register, mangled, pkg)
 
 		bbRegisterInit.Body.List = append(bbRegisterInit.Body.List, &ast.ExprStmt{X: &ast.CallExpr{
 			Fun: ast.NewIdent("Register"),
@@ -525,16 +848,69 @@ func CreateBBMainSource(p *packages.Package, pkgs []string, destDir string) erro
 					Value: strconv.Quote(name),
 				},
 				// init=
-				ast.NewIdent(fmt.Sprintf("mangled%s.Init", name)),
+				ast.NewIdent(fmt.Sprintf("%s.Init", mangled)),
 				// main=
-				ast.NewIdent(fmt.Sprintf("mangled%s.Main", name)),
+				ast.NewIdent(fmt.Sprintf("%s.Main", mangled)),
 			},
 		}})
 
+		// RegisterSynopsis("pkg", "synopsis")
+		if synopsis := opts.Synopses[name]; synopsis != "" && hasSynopses {
+			bbRegisterInit.Body.List = append(bbRegisterInit.Body.List, &ast.ExprStmt{X: &ast.CallExpr{
+				Fun: ast.NewIdent("RegisterSynopsis"),
+				Args: []ast.Expr{
+					&ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(name)},
+					&ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(synopsis)},
+				},
+			}})
+		}
+
+		// mangledpkg.BBExit = Exit
+		if opts.InterceptExit {
+			bbRegisterInit.Body.List = append(bbRegisterInit.Body.List, &ast.AssignStmt{
+				Lhs: []ast.Expr{ast.NewIdent(fmt.Sprintf("%s.BBExit", mangled))},
+				Tok: token.ASSIGN,
+				Rhs: []ast.Expr{ast.NewIdent("Exit")},
+			})
+		}
 	}
 
-	p.Syntax[0].Decls = append(p.Syntax[0].Decls, bbRegisterInit)
-	return writeFiles(destDir, p.Fset, p.Syntax)
+	// RegisterAlias("alias", "name")
+	var aliases []string
+	for alias := range opts.Aliases {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	for _, alias := range aliases {
+		bbRegisterInit.Body.List = append(bbRegisterInit.Body.List, &ast.ExprStmt{X: &ast.CallExpr{
+			Fun: ast.NewIdent("RegisterAlias"),
+			Args: []ast.Expr{
+				&ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(alias)},
+				&ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(opts.Aliases[alias])},
+			},
+		}})
+	}
+
+	if opts.ExitPanics {
+		bbRegisterInit.Body.List = append(bbRegisterInit.Body.List, &ast.AssignStmt{
+			Lhs: []ast.Expr{ast.NewIdent("ExitPanics")},
+			Tok: token.ASSIGN,
+			Rhs: []ast.Expr{ast.NewIdent("true")},
+		})
+	}
+	if opts.DefaultCommand != "" {
+		bbRegisterInit.Body.List = append(bbRegisterInit.Body.List, &ast.AssignStmt{
+			Lhs: []ast.Expr{ast.NewIdent("DefaultCmd")},
+			Tok: token.ASSIGN,
+			Rhs: []ast.Expr{&ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(opts.DefaultCommand)}},
+		})
+	}
+
+	register.Decls = append(register.Decls, bbRegisterInit)
+	if err := writeFiles(destDir, p.Fset, p.Syntax); err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(destDir, RegisterFile), p.Fset, register)
 }
 
 // Package is a Go package.
@@ -548,6 +924,15 @@ type Package struct {
 	// Pkg is the actual data about the package.
 	Pkg *packages.Package
 
+	// InterceptExit routes the command's calls of os.Exit, log.Fatal,
+	// flag.Parse and similar functions that exit through the exported
+	// variable BBExit, which the busybox sets to its exit hook.
+	//
+	// Functions and methods are found by type-checking, so renamed and dot
+	// imports are handled, but function values of methods, e.g.
+	// `fatal := logger.Fatal`, still exit directly.
+	InterceptExit bool
+
 	// initCount keeps track of what the next init's index should be.
 	initCount uint
 
@@ -569,6 +954,18 @@ type Package struct {
 	//
 	// The key Expr must also be the AssignStmt.Rhs[0].
 	initAssigns map[ast.Expr]ast.Stmt
+
+	// kept are the global declarations that stay initialized at package
+	// level, because their types cannot be spelled out and zeroValues
+	// cannot declare them otherwise, and why.
+	kept map[*ast.ValueSpec]error
+
+	// zeroFuncs are the names of the bbZeroOf functions declared so far.
+	zeroFuncs map[string]bool
+
+	// raiseVersion are the files whose language version must be raised
+	// to Go 1.18 for the bbZeroOf functions.
+	raiseVersion map[*ast.File]bool
 }
 
 // modules returns a list of module directories => directories of packages
@@ -609,7 +1006,11 @@ func modules(filesystemPaths []string) (map[string][]string, []string) {
 //
 // Namely, PWD determines which go.mod to use. We want each
 // package to use its own go.mod, if it has one.
-func loadFSPackages(env golang.Environ, filesystemPaths []string) ([]*packages.Package, error) {
+//
+// Each module is loaded separately, and up to jobs modules are loaded
+// concurrently. The commands of each module are reported to r once the module
+// is loaded.
+func loadFSPackages(ctx context.Context, r *reporter, env golang.Environ, jobs int, filesystemPaths []string) ([]*packages.Package, error) {
 	var absPaths []string
 	for _, fsPath := range filesystemPaths {
 		absPath, err := filepath.Abs(fsPath)
@@ -619,94 +1020,257 @@ func loadFSPackages(env golang.Environ, filesystemPaths []string) ([]*packages.P
 		absPaths = append(absPaths, absPath)
 	}
 
-	var allps []*packages.Package
-
 	mods, noModulePkgDirs := modules(absPaths)
 
-	for moduleDir, pkgDirs := range mods {
-		pkgs, err := loadFSPkgs(env, moduleDir, pkgDirs...)
-		if err != nil {
-			return nil, fmt.Errorf("could not find packages %v in module %s: %v", pkgDirs, moduleDir, err)
-		}
-		for _, pkg := range pkgs {
-			allps = addPkg(allps, pkg)
-		}
+	// Sort modules so that the resulting package order is deterministic.
+	var moduleDirs []string
+	for moduleDir := range mods {
+		moduleDirs = append(moduleDirs, moduleDir)
 	}
+	sort.Strings(moduleDirs)
 
+	type loadJob struct {
+		dir     string
+		pkgDirs []string
+	}
+	var loadJobs []loadJob
+	for _, moduleDir := range moduleDirs {
+		loadJobs = append(loadJobs, loadJob{dir: moduleDir, pkgDirs: mods[moduleDir]})
+	}
 	if len(noModulePkgDirs) > 0 {
 		// The directory we choose can be any dir that does not have a
 		// go.mod anywhere in its parent tree.
-		vendoredPkgs, err := loadFSPkgs(env, noModulePkgDirs[0], noModulePkgDirs...)
+		loadJobs = append(loadJobs, loadJob{dir: noModulePkgDirs[0], pkgDirs: noModulePkgDirs})
+	}
+
+	results := make([][]*packages.Package, len(loadJobs))
+	err := parallel(ctx, jobs, len(loadJobs), func(i int) error {
+		start := time.Now()
+		j := loadJobs[i]
+		pkgs, err := loadFSPkgs(ctx, env, j.dir, j.pkgDirs...)
 		if err != nil {
-			return nil, fmt.Errorf("could not find packages %v: %v", noModulePkgDirs, err)
-		}
-		for _, p := range vendoredPkgs {
-			allps = addPkg(allps, p)
+			return fmt.Errorf("could not find packages %v in %s: %w", j.pkgDirs, j.dir, err)
 		}
+		r.loaded(pkgs, start)
+		results[i] = pkgs
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var allps []*packages.Package
+	for _, pkgs := range results {
+		allps = append(allps, pkgs...)
 	}
 	return allps, nil
 }
 
-func addPkg(plist []*packages.Package, p *packages.Package) []*packages.Package {
+// notCommand returns why p cannot be compiled into a busybox, or nil if it
+// can.
+func notCommand(p *packages.Package) error {
 	if len(p.Errors) > 0 {
-		// TODO(chrisko): should we return an error here instead of warn?
-		log.Printf("Skipping package %v for errors:", p)
-		packages.PrintErrors([]*packages.Package{p})
+		return packageErrors(p)
 	} else if len(p.GoFiles) == 0 {
-		log.Printf("Skipping package %v because it has no Go files", p)
+		return &NotCommandError{ID: p.ID, Reason: "it has no Go files"}
 	} else if p.Name != "main" {
-		log.Printf("Skipping package %v because it is not a command (must be `package main`)", p)
-	} else {
-		plist = append(plist, p)
+		return &NotCommandError{ID: p.ID, Reason: "it is not a command (must be `package main`)"}
 	}
-	return plist
+	return nil
 }
 
 // NewPackages collects package metadata about all named packages.
 //
-// names can either be directory paths or Go import paths.
+// names can either be directory paths or Go import paths. Packages that are
+// not commands or fail to load are skipped.
 func NewPackages(env golang.Environ, names ...string) ([]*Package, error) {
+	return NewPackagesWithOpts(env, &PackagesOpts{}, names...)
+}
+
+// PackagesOpts are the options of NewPackagesWithOpts.
+type PackagesOpts struct {
+	// Logger is warned about skipped packages. If nil, warnings are
+	// discarded.
+	Logger Logger
+}
+
+// NewPackagesWithOpts is like NewPackages, but with options.
+func NewPackagesWithOpts(env golang.Environ, opts *PackagesOpts, names ...string) ([]*Package, error) {
+	return newPackages(context.Background(), newReporter(&Opts{Logger: opts.Logger}), env, 0, false, names...)
+}
+
+// newPackages is NewPackages, loading up to jobs modules concurrently until ctx
+// is done.
+//
+// If strict is set, each of names that yields no command or matches a package
+// that fails to load fails the call with a SkippedPackagesError listing all of
+// them. Packages that are not commands, but matched by a pattern along with
+// commands, are still skipped.
+//
+// Skipped packages are logged to r, and loaded commands reported to it as
+// soon as they are loaded.
+func newPackages(ctx context.Context, r *reporter, env golang.Environ, jobs int, strict bool, names ...string) ([]*Package, error) {
 	var goImportPaths []string
 	var filesystemPaths []string
+	var reqs []*request
 
 	for _, name := range names {
 		if strings.HasPrefix(name, ".") || strings.HasPrefix(name, "/") {
 			filesystemPaths = append(filesystemPaths, name)
+			reqs = append(reqs, newFSRequest(name))
 		} else if _, err := os.Stat(name); err == nil {
 			filesystemPaths = append(filesystemPaths, name)
+			reqs = append(reqs, newFSRequest(name))
 		} else {
 			goImportPaths = append(goImportPaths, name)
+			reqs = append(reqs, &request{name: name, match: matchPattern(name), path: lookupPath})
 		}
 	}
 
 	var ps []*packages.Package
 	if len(goImportPaths) > 0 {
-		importPkgs, err := loadPkgs(env, "", goImportPaths...)
+		start := time.Now()
+		importPkgs, err := loadPkgs(ctx, env, "", goImportPaths...)
 		if err != nil {
-			return nil, fmt.Errorf("failed to load package %v: %v", goImportPaths, err)
-		}
-		for _, p := range importPkgs {
-			ps = addPkg(ps, p)
+			return nil, fmt.Errorf("failed to load package %v: %w", goImportPaths, err)
 		}
+		r.loaded(importPkgs, start)
+		ps = append(ps, importPkgs...)
 	}
 
-	pkgs, err := loadFSPackages(env, filesystemPaths)
+	pkgs, err := loadFSPackages(ctx, r, env, jobs, filesystemPaths)
 	if err != nil {
-		return nil, fmt.Errorf("could not load packages from file system: %v", err)
+		return nil, fmt.Errorf("could not load packages from file system: %w", err)
 	}
 	ps = append(ps, pkgs...)
 
 	var ips []*Package
-	for _, p := range ps {
-		ips = append(ips, NewPackage(path.Base(p.PkgPath), p))
+	errs := make([]error, len(ps))
+	for i, p := range ps {
+		errs[i] = notCommand(p)
+		for _, req := range reqs {
+			if req.matches(p) {
+				req.add(errs[i])
+			}
+		}
+		if errs[i] == nil {
+			ips = append(ips, NewPackage(path.Base(p.PkgPath), p))
+		}
+	}
+
+	var skipped SkippedPackagesError
+	if strict {
+		fatal := make(map[error]bool)
+		for _, req := range reqs {
+			for _, err := range req.errs {
+				var le *LoadError
+				if req.cmds == 0 || errors.As(err, &le) {
+					fatal[err] = true
+				}
+			}
+			if req.cmds == 0 && len(req.errs) == 0 {
+				skipped = append(skipped, &NotCommandError{ID: req.name, Reason: "it matches no packages"})
+			}
+		}
+		for i, err := range errs {
+			// Packages that match none of names, such as packages
+			// that could not be found, fail to load.
+			if err != nil && (fatal[err] || !matchedAny(reqs, ps[i])) {
+				skipped = append(skipped, err)
+				errs[i] = nil
+			}
+		}
+	}
+	for i, err := range errs {
+		if err != nil {
+			r.l.Logf(LevelWarning, "Skipping package %v: %v", ps[i], err)
+		}
+	}
+	if len(skipped) > 0 {
+		return nil, skipped
 	}
 	return ips, nil
 }
 
+// request is one of the names given to newPackages, and what it yielded.
+type request struct {
+	name string
+
+	// match reports whether the path of a package, as returned by path,
+	// matches name.
+	match func(string) bool
+	path  func(*packages.Package) string
+
+	// cmds is the number of commands matched, and errs the reasons of the
+	// other packages matched for not being commands.
+	cmds int
+	errs []error
+}
+
+// newFSRequest returns the request of a file system path or pattern, which
+// matches package directories.
+func newFSRequest(name string) *request {
+	absPath, err := filepath.Abs(name)
+	if err != nil {
+		absPath = name
+	}
+	return &request{name: name, match: matchPattern(absPath), path: lookupDir}
+}
+
+func (req *request) matches(p *packages.Package) bool {
+	path := req.path(p)
+	return path != "" && req.match(path)
+}
+
+func (req *request) add(err error) {
+	if err == nil {
+		req.cmds++
+	} else {
+		req.errs = append(req.errs, err)
+	}
+}
+
+// matchedAny reports whether any of reqs matches p.
+func matchedAny(reqs []*request, p *packages.Package) bool {
+	for _, req := range reqs {
+		if req.matches(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupPath returns the import path p was looked up by. Packages that could
+// not be found may only have an ID.
+func lookupPath(p *packages.Package) string {
+	if p.PkgPath != "" {
+		return p.PkgPath
+	}
+	return p.ID
+}
+
+// lookupDir returns the directory p was looked up in.
+func lookupDir(p *packages.Package) string {
+	return p.Dir
+}
+
+// matchPattern returns a function reporting whether a package path or
+// directory matches pattern, in which "..." matches any string, as it does
+// for the go command.
+func matchPattern(pattern string) func(string) bool {
+	re := regexp.QuoteMeta(pattern)
+	re = strings.Replace(re, `\.\.\.`, `.*`, -1)
+	// Like the go command, foo/... also matches foo.
+	if strings.HasSuffix(re, `/.*`) {
+		re = strings.TrimSuffix(re, `/.*`) + `(/.*)?`
+	}
+	return regexp.MustCompile(`^` + re + `$`).MatchString
+}
+
 // loadFSPkgs looks up importDirs packages, making the import path relative to
 // `dir`. `go list -json` requires the import path to be relative to the dir
 // when the package is outside of a $GOPATH and there is no go.mod in any parent directory.
-func loadFSPkgs(env golang.Environ, dir string, importDirs ...string) ([]*packages.Package, error) {
+func loadFSPkgs(ctx context.Context, env golang.Environ, dir string, importDirs ...string) ([]*packages.Package, error) {
 	var relImportDirs []string
 	for _, importDir := range importDirs {
 		relImportDir, err := filepath.Rel(dir, importDir)
@@ -720,25 +1284,87 @@ func loadFSPkgs(env golang.Environ, dir string, importDirs ...string) ([]*packag
 		// the latter looks in the relative directory ./cmd/foo.
 		relImportDirs = append(relImportDirs, "./"+relImportDir)
 	}
-	return loadPkgs(env, dir, relImportDirs...)
+	pkgs, err := loadPkgs(ctx, env, dir, relImportDirs...)
+	if err != nil {
+		return nil, err
+	}
+	// Packages that could not be found have no directory, but their ID is
+	// the relative path they were looked up by. Give them the directory
+	// they were looked up in, so that they can be traced back to it.
+	for _, p := range pkgs {
+		if p.Dir == "" && strings.HasPrefix(p.ID, "./") {
+			p.Dir = filepath.Join(dir, p.ID)
+		}
+	}
+	return pkgs, nil
 }
 
-func loadPkgs(env golang.Environ, dir string, patterns ...string) ([]*packages.Package, error) {
+// loadPkgs loads the packages matching patterns.
+//
+// Only the matched packages are parsed and type-checked from source. We need
+// their syntax and type information to rewrite them, but for dependencies we
+// only need to know which module and files they consist of in order to copy
+// them. Type-checking the entire transitive closure of dependencies from
+// source is what used to make large busyboxes slow and memory-hungry.
+//
+// So there are two loads:
+//
+//   - one for the metadata of the whole dependency graph, which is just a
+//     `go list -deps` invocation, and
+//   - one for syntax and types of the matched packages, in which the types of
+//     dependencies are read from compiler export data.
+func loadPkgs(ctx context.Context, env golang.Environ, dir string, patterns ...string) ([]*packages.Package, error) {
 	cfg := &packages.Config{
-		Mode: packages.NeedName | packages.NeedImports | packages.NeedFiles | packages.NeedDeps | packages.NeedTypes | packages.NeedSyntax | packages.NeedTypesInfo | packages.NeedCompiledGoFiles | packages.NeedModule,
-		Env:  append(os.Environ(), env.Env()...),
-		Dir:  dir,
+		Mode:    packages.NeedName | packages.NeedImports | packages.NeedFiles | packages.NeedDeps | packages.NeedCompiledGoFiles | packages.NeedModule | packages.NeedEmbedFiles,
+		Context: ctx,
+		Env:     append(os.Environ(), env.Env()...),
+		Dir:     dir,
+	}
+	pkgs, err := packages.Load(cfg, patterns...)
+	if err != nil {
+		return nil, err
 	}
-	return packages.Load(cfg, patterns...)
+
+	// Without NeedDeps, go/packages type-checks dependencies from export
+	// data rather than source.
+	typedCfg := *cfg
+	typedCfg.Mode = packages.NeedName | packages.NeedImports | packages.NeedFiles | packages.NeedCompiledGoFiles | packages.NeedTypes | packages.NeedTypesSizes | packages.NeedSyntax | packages.NeedTypesInfo
+	typedPkgs, err := packages.Load(&typedCfg, patterns...)
+	if err != nil {
+		return nil, err
+	}
+	typed := make(map[string]*packages.Package)
+	for _, p := range typedPkgs {
+		typed[p.ID] = p
+	}
+
+	// Attach syntax and types to the packages of the dependency graph.
+	for _, p := range pkgs {
+		t, ok := typed[p.ID]
+		if !ok {
+			continue
+		}
+		p.Fset = t.Fset
+		p.Syntax = t.Syntax
+		p.Types = t.Types
+		p.TypesInfo = t.TypesInfo
+		p.TypesSizes = t.TypesSizes
+		// Includes the metadata load's errors as well as type errors.
+		p.Errors = t.Errors
+	}
+	return pkgs, nil
 }
 
 // NewPackage creates a new Package based on an existing packages.Package.
 func NewPackage(name string, p *packages.Package) *Package {
 	pp := &Package{
 		// Name is the executable name.
-		Name:        path.Base(name),
-		Pkg:         p,
-		initAssigns: make(map[ast.Expr]ast.Stmt),
+		Name:         path.Base(name),
+		Pkg:          p,
+		initAssigns:  make(map[ast.Expr]ast.Stmt),
+		kept:         make(map[*ast.ValueSpec]error),
+		zeroFuncs:    make(map[string]bool),
+		raiseVersion: make(map[*ast.File]bool),
 	}
 
 	// This Init will hold calls to all other InitXs.
@@ -762,40 +1388,396 @@ func (p *Package) nextInit(addToCallList bool) *ast.Ident {
 	return i
 }
 
-// TODO:
-// - write an init name generator, in case InitN is already taken.
-func (p *Package) rewriteFile(f *ast.File) bool {
-	hasMain := false
+// newInitAssign returns a new InitN function assigning rhs to lhs.
+//
+// A call to it is recorded in initAssigns, so that it can be added to Init0
+// in the correct init order later.
+func (p *Package) newInitAssign(lhs []ast.Expr, rhs ast.Expr) *ast.FuncDecl {
+	varInit := &ast.FuncDecl{
+		Name: p.nextInit(false),
+		Type: &ast.FuncType{
+			Params:  &ast.FieldList{},
+			Results: nil,
+		},
+		Body: &ast.BlockStmt{
+			List: []ast.Stmt{
+				&ast.AssignStmt{
+					Lhs: lhs,
+					Tok: token.ASSIGN,
+					Rhs: []ast.Expr{rhs},
+				},
+			},
+		},
+	}
+	p.initAssigns[rhs] = &ast.ExprStmt{X: &ast.CallExpr{Fun: varInit.Name}}
+	return varInit
+}
 
-	// Change the package name declaration from main to the command's name.
-	f.Name.Name = p.Name
+// specTypes returns expressions for the types that the names of s, which has
+// no explicit type, were inferred to have.
+//
+// If all names have the same type, a single expression is returned. If a type
+// cannot be spelled out in the file, nil is returned.
+func (p *Package) specTypes(s *ast.ValueSpec, namer *typeNamer) ([]ast.Expr, error) {
+	var typs []types.Type
+	for _, name := range s.Names {
+		obj := p.Pkg.TypesInfo.Defs[name]
+		if obj == nil || obj.Type() == nil || obj.Type() == types.Typ[types.Invalid] {
+			return nil, &RewriteError{
+				PkgPath: p.Pkg.PkgPath,
+				Pos:     p.Pkg.Fset.Position(name.Pos()),
+				Err:     fmt.Errorf("cannot infer type of global %s; declare it with an explicit type", name),
+			}
+		}
+		typs = append(typs, obj.Type())
+	}
 
-	// Map of fully qualified package name -> imported alias in the file.
-	importAliases := make(map[string]string)
-	for _, impt := range f.Imports {
-		if impt.Name != nil {
-			importPath, err := strconv.Unquote(impt.Path.Value)
-			if err != nil {
-				panic(err)
+	same := true
+	for _, typ := range typs[1:] {
+		same = same && types.Identical(typ, typs[0])
+	}
+	if same {
+		typs = typs[:1]
+	}
+
+	namer.pos = s.Pos()
+	var exprs []ast.Expr
+	for i, typ := range typs {
+		x, err := namer.expr(typ)
+		if err != nil {
+			namer.discard()
+			p.kept[s] = fmt.Errorf("cannot spell out type of global %s: %v", s.Names[i], err)
+			return nil, nil
+		}
+		exprs = append(exprs, x)
+	}
+	namer.commit()
+	return exprs, nil
+}
+
+// typeSpecs gives the names of s the types typs returned by specTypes.
+//
+// Names of different types, as in var a, b = 1, "b", are split into one spec
+// each.
+func typeSpecs(s *ast.ValueSpec, typs []ast.Expr) []ast.Spec {
+	if len(typs) == 1 {
+		s.Type = typs[0]
+		return []ast.Spec{s}
+	}
+
+	var specs []ast.Spec
+	for i, name := range s.Names {
+		spec := &ast.ValueSpec{
+			Names: []*ast.Ident{name},
+			Type:  typs[i],
+		}
+		if i == 0 {
+			spec.Doc = s.Doc
+		}
+		if i == len(s.Names)-1 {
+			spec.Comment = s.Comment
+		}
+		specs = append(specs, spec)
+	}
+	return specs
+}
+
+// zeroValues returns expressions for zero values of the types of the
+// initializers of s, which can be declared instead when the types cannot be
+// spelled out, or nil.
+//
+// Calls of functions and methods, and global variables are supported: f(x) is
+// replaced by bbZeroOf1_1(f), a generic function declared in f's file that
+// infers the result type of f and returns its zero value without calling f,
+// and a variable v by bbZeroOfValue(v). Type parameters require Go 1.18, so
+// files of modules of older Go versions are marked to have their language
+// version raised by raiseGoVersion.
+func (p *Package) zeroValues(f *ast.File, s *ast.ValueSpec, namer *typeNamer) []ast.Expr {
+	results := 1
+	if len(s.Values) != len(s.Names) {
+		results = len(s.Names)
+	}
+
+	namer.pos = s.Pos()
+	var zeros []ast.Expr
+	var decls []ast.Decl
+	for _, v := range s.Values {
+		v = astutil.Unparen(v)
+		if results == 1 && p.isGlobalVar(v) {
+			if !p.zeroFuncs[zeroValueFunc] {
+				p.zeroFuncs[zeroValueFunc] = true
+				decls = append(decls, zeroFunc(zeroValueFunc, -1, false, 1))
+			}
+			zeros = append(zeros, &ast.CallExpr{Fun: ast.NewIdent(zeroValueFunc), Args: []ast.Expr{v}})
+			continue
+		}
+
+		call, ok := v.(*ast.CallExpr)
+		if !ok {
+			namer.discard()
+			return nil
+		}
+		fun, sig := p.callee(call, namer)
+		if fun == nil || sig.Results().Len() != results {
+			namer.discard()
+			return nil
+		}
+
+		params := sig.Params().Len()
+		if sig.Recv() != nil {
+			// Method expressions take the receiver first.
+			params++
+		}
+		name := fmt.Sprintf("bbZeroOf%d_%d", params, results)
+		if sig.Variadic() {
+			name = fmt.Sprintf("bbZeroOf%dv_%d", params, results)
+		}
+		if !p.zeroFuncs[name] {
+			p.zeroFuncs[name] = true
+			decls = append(decls, zeroFunc(name, params, sig.Variadic(), results))
+		}
+		zeros = append(zeros, &ast.CallExpr{Fun: ast.NewIdent(name), Args: []ast.Expr{fun}})
+	}
+	namer.commit()
+	f.Decls = append(f.Decls, decls...)
+	if p.Pkg.Module != nil {
+		v := p.Pkg.Module.GoVersion
+		if v == "" {
+			// The go command's default for go.mod files
+			// without a go directive.
+			v = "1.16"
+		}
+		if version.Compare("go"+v, "go1.18") < 0 {
+			p.raiseVersion[f] = true
+		}
+	}
+	return zeros
+}
+
+// zeroValueFunc is the name of the function that zeroValues uses for
+// variables:
+//
+//	func bbZeroOfValue[T any](T) (t T) { return }
+const zeroValueFunc = "bbZeroOfValue"
+
+// isGlobalVar reports whether x is a global variable of p, or a qualified
+// identifier of a variable of another package. Variables are cheap to read
+// and cannot panic, so initializers that are variables can be evaluated at
+// package initialization.
+func (p *Package) isGlobalVar(x ast.Expr) bool {
+	info := p.Pkg.TypesInfo
+	switch x := x.(type) {
+	case *ast.Ident:
+		v, ok := info.Uses[x].(*types.Var)
+		return ok && v.Parent() == p.Pkg.Types.Scope()
+	case *ast.SelectorExpr:
+		pkg, ok := x.X.(*ast.Ident)
+		if !ok {
+			return false
+		}
+		if _, ok := info.Uses[pkg].(*types.PkgName); !ok {
+			return false
+		}
+		_, ok = info.Uses[x.Sel].(*types.Var)
+		return ok
+	}
+	return false
+}
+
+// callee returns an expression for the function or method that call calls,
+// and its signature, or nil if it is neither or the expression cannot be
+// spelled out in the file.
+//
+// Methods are returned as method expressions, e.g. (*T).M for x.M, so that
+// x is not evaluated.
+func (p *Package) callee(call *ast.CallExpr, namer *typeNamer) (ast.Expr, *types.Signature) {
+	info := p.Pkg.TypesInfo
+	fun := astutil.Unparen(call.Fun)
+
+	// funcObj returns the non-generic function that id refers to, or nil.
+	funcObj := func(id *ast.Ident) *types.Func {
+		fn, ok := info.Uses[id].(*types.Func)
+		if !ok || fn.Type().(*types.Signature).TypeParams().Len() > 0 {
+			return nil
+		}
+		return fn
+	}
+
+	switch x := fun.(type) {
+	case *ast.Ident:
+		if fn := funcObj(x); fn != nil && fn.Type().(*types.Signature).Recv() == nil {
+			return ast.NewIdent(x.Name), fn.Type().(*types.Signature)
+		}
+
+	case *ast.SelectorExpr:
+		sel, ok := info.Selections[x]
+		if !ok {
+			// A qualified identifier, pkg.F. Without Selections, x.M
+			// of a method M also ends up here.
+			pkg, ok := x.X.(*ast.Ident)
+			if !ok {
+				return nil, nil
+			}
+			if _, ok := info.Uses[pkg].(*types.PkgName); !ok {
+				return nil, nil
+			}
+			if fn := funcObj(x.Sel); fn != nil && fn.Type().(*types.Signature).Recv() == nil {
+				return &ast.SelectorExpr{X: ast.NewIdent(pkg.Name), Sel: ast.NewIdent(x.Sel.Name)}, fn.Type().(*types.Signature)
+			}
+			return nil, nil
+		}
+		if sel.Kind() != types.MethodVal {
+			return nil, nil
+		}
+		fn := sel.Obj().(*types.Func)
+		recv := sel.Recv()
+		if types.NewMethodSet(recv).Lookup(fn.Pkg(), fn.Name()) == nil {
+			recv = types.NewPointer(recv)
+		}
+		typ, err := namer.expr(recv)
+		if err != nil {
+			return nil, nil
+		}
+		if _, ok := typ.(*ast.StarExpr); ok {
+			typ = &ast.ParenExpr{X: typ}
+		}
+		return &ast.SelectorExpr{X: typ, Sel: ast.NewIdent(x.Sel.Name)}, fn.Type().(*types.Signature)
+	}
+	return nil, nil
+}
+
+// zeroFunc returns the declaration of a generic function named name that
+// takes a function with params parameters and results results, and returns
+// zero values of its result types:
+//
+//	func bbZeroOf1_1[P1, R1 any](func(P1) R1) (r1 R1) { return }
+//
+// If params is -1, the function takes a value of its result type instead.
+func zeroFunc(name string, params int, variadic bool, results int) *ast.FuncDecl {
+	if params < 0 {
+		return &ast.FuncDecl{
+			Name: ast.NewIdent(name),
+			Type: &ast.FuncType{
+				TypeParams: &ast.FieldList{List: []*ast.Field{{Names: []*ast.Ident{ast.NewIdent("T")}, Type: ast.NewIdent("any")}}},
+				Params:     &ast.FieldList{List: []*ast.Field{{Type: ast.NewIdent("T")}}},
+				Results:    &ast.FieldList{List: []*ast.Field{{Names: []*ast.Ident{ast.NewIdent("t")}, Type: ast.NewIdent("T")}}},
+			},
+			Body: &ast.BlockStmt{List: []ast.Stmt{&ast.ReturnStmt{}}},
+		}
+	}
+	var typeParams []*ast.Ident
+	fn := &ast.FuncType{Params: &ast.FieldList{}, Results: &ast.FieldList{}}
+	for i := 1; i <= params; i++ {
+		p := fmt.Sprintf("P%d", i)
+		typeParams = append(typeParams, ast.NewIdent(p))
+		var typ ast.Expr = ast.NewIdent(p)
+		if variadic && i == params {
+			typ = &ast.Ellipsis{Elt: typ}
+		}
+		fn.Params.List = append(fn.Params.List, &ast.Field{Type: typ})
+	}
+	var zeros []*ast.Field
+	for i := 1; i <= results; i++ {
+		r := fmt.Sprintf("R%d", i)
+		typeParams = append(typeParams, ast.NewIdent(r))
+		fn.Results.List = append(fn.Results.List, &ast.Field{Type: ast.NewIdent(r)})
+		zeros = append(zeros, &ast.Field{
+			Names: []*ast.Ident{ast.NewIdent(fmt.Sprintf("r%d", i))},
+			Type:  ast.NewIdent(r),
+		})
+	}
+	return &ast.FuncDecl{
+		Name: ast.NewIdent(name),
+		Type: &ast.FuncType{
+			TypeParams: &ast.FieldList{List: []*ast.Field{{Names: typeParams, Type: ast.NewIdent("any")}}},
+			Params:     &ast.FieldList{List: []*ast.Field{{Type: fn}}},
+			Results:    &ast.FieldList{List: zeros},
+		},
+		Body: &ast.BlockStmt{List: []ast.Stmt{&ast.ReturnStmt{}}},
+	}
+}
+
+// keptInit returns true if init initializes a kept global.
+func (p *Package) keptInit(init *types.Initializer) bool {
+	for s := range p.kept {
+		for _, v := range s.Values {
+			if v == init.Rhs {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkKept returns an error if the initializer of a kept global depends on
+// a global whose initialization was moved into Init, as kept globals are
+// initialized before Init runs.
+func (p *Package) checkKept() error {
+	if len(p.kept) == 0 {
+		return nil
+	}
+
+	moved := make(map[types.Object]bool)
+	funcs := make(map[types.Object]*ast.FuncDecl)
+	for _, f := range p.Pkg.Syntax {
+		for _, decl := range f.Decls {
+			switch d := decl.(type) {
+			case *ast.GenDecl:
+				for _, spec := range d.Specs {
+					if s, ok := spec.(*ast.ValueSpec); ok && p.kept[s] == nil {
+						for _, name := range s.Names {
+							moved[p.Pkg.TypesInfo.Defs[name]] = true
+						}
+					}
+				}
+			case *ast.FuncDecl:
+				funcs[p.Pkg.TypesInfo.Defs[d.Name]] = d
 			}
-			importAliases[importPath] = impt.Name.Name
 		}
 	}
 
-	// When the types.TypeString function translates package names, it uses
-	// this function to map fully qualified package paths to a local alias,
-	// if it exists.
-	qualifier := func(pkg *types.Package) string {
-		name, ok := importAliases[pkg.Path()]
-		if ok {
-			return name
+	for s, reason := range p.kept {
+		var dep types.Object
+		visited := make(map[ast.Node]bool)
+		var visit func(n ast.Node) bool
+		visit = func(n ast.Node) bool {
+			id, ok := n.(*ast.Ident)
+			if !ok || dep != nil {
+				return dep == nil
+			}
+			obj := p.Pkg.TypesInfo.Uses[id]
+			if moved[obj] {
+				dep = obj
+			} else if fn, ok := funcs[obj]; ok && !visited[fn] {
+				visited[fn] = true
+				ast.Inspect(fn.Body, visit)
+			}
+			return dep == nil
+		}
+		for _, v := range s.Values {
+			ast.Inspect(v, visit)
 		}
-		// When referring to self, don't use any package name.
-		if pkg == p.Pkg.Types {
-			return ""
+		if dep != nil {
+			return &RewriteError{
+				PkgPath: p.Pkg.PkgPath,
+				Pos:     p.Pkg.Fset.Position(s.Pos()),
+				Err:     fmt.Errorf("%v, and its initializer depends on global %s", reason, dep.Name()),
+			}
 		}
-		return pkg.Name()
 	}
+	return nil
+}
+
+// TODO:
+// - write an init name generator, in case InitN is already taken.
+func (p *Package) rewriteFile(f *ast.File) (bool, error) {
+	hasMain := false
+
+	// Change the package name declaration from main to the command's name.
+	f.Name.Name = p.Name
+
+	// Types of globals are spelled out in this file.
+	namer := newTypeNamer(p, f)
 
 	for _, decl := range f.Decls {
 		switch d := decl.(type) {
@@ -804,47 +1786,63 @@ func (p *Package) rewriteFile(f *ast.File) bool {
 			if d.Tok != token.VAR {
 				break
 			}
+			var specs []ast.Spec
 			for _, spec := range d.Specs {
 				s := spec.(*ast.ValueSpec)
+				// Variables without initializers stay as they
+				// are. This includes go:embed variables, which
+				// cannot have initializers and must stay with
+				// their directive.
 				if s.Values == nil {
+					specs = append(specs, s)
 					continue
 				}
 
+				var typs, zeros []ast.Expr
+				if s.Type == nil {
+					var err error
+					typs, err = p.specTypes(s, namer)
+					if err != nil {
+						return false, err
+					}
+					// Globals whose type cannot be spelled
+					// out are declared with zero values of
+					// their type, or else kept as they are.
+					if typs == nil {
+						if zeros = p.zeroValues(f, s, namer); zeros == nil {
+							specs = append(specs, s)
+							continue
+						}
+						delete(p.kept, s)
+					}
+				}
+
 				// For each assignment, create a new init
 				// function, and place it in the same file.
-				for i, name := range s.Names {
-					varInit := &ast.FuncDecl{
-						Name: p.nextInit(false),
-						Type: &ast.FuncType{
-							Params:  &ast.FieldList{},
-							Results: nil,
-						},
-						Body: &ast.BlockStmt{
-							List: []ast.Stmt{
-								&ast.AssignStmt{
-									Lhs: []ast.Expr{name},
-									Tok: token.ASSIGN,
-									Rhs: []ast.Expr{s.Values[i]},
-								},
-							},
-						},
+				//
+				// var a, b = f() is a single assignment.
+				if len(s.Values) == len(s.Names) {
+					for i, name := range s.Names {
+						f.Decls = append(f.Decls, p.newInitAssign([]ast.Expr{name}, s.Values[i]))
+					}
+				} else {
+					var lhs []ast.Expr
+					for _, name := range s.Names {
+						lhs = append(lhs, name)
 					}
-					// Add a call to the new init func to
-					// this map, so they can be added to
-					// Init0() in the correct init order
-					// later.
-					p.initAssigns[s.Values[i]] = &ast.ExprStmt{X: &ast.CallExpr{Fun: varInit.Name}}
-					f.Decls = append(f.Decls, varInit)
+					f.Decls = append(f.Decls, p.newInitAssign(lhs, s.Values[0]))
 				}
 
 				// Add the type of the expression to the global
 				// declaration instead.
-				if s.Type == nil {
-					typ := p.Pkg.TypesInfo.Types[s.Values[0]]
-					s.Type = ast.NewIdent(types.TypeString(typ.Type, qualifier))
+				s.Values = zeros
+				if s.Type != nil || zeros != nil {
+					specs = append(specs, s)
+					continue
 				}
-				s.Values = nil
+				specs = append(specs, typeSpecs(s, typs)...)
 			}
+			d.Specs = specs
 
 		case *ast.FuncDecl:
 			if d.Recv == nil && d.Name.Name == "main" {
@@ -857,6 +1855,8 @@ func (p *Package) rewriteFile(f *ast.File) bool {
 		}
 	}
 
+	namer.addImports(p.Pkg.Fset)
+
 	// Now we change any import names attached to package declarations. We
 	// just upcase it for now; it makes it easy to look in bbsh for things
 	// we changed, e.g. grep -r bbsh Import is useful.
@@ -867,7 +1867,18 @@ func (p *Package) rewriteFile(f *ast.File) bool {
 			}
 		}
 	}
-	return hasMain
+	return hasMain, nil
+}
+
+// pkgDir returns the directory containing p's source files.
+func pkgDir(p *packages.Package) string {
+	if len(p.GoFiles) > 0 {
+		return filepath.Dir(p.GoFiles[0])
+	}
+	if len(p.CompiledGoFiles) > 0 {
+		return filepath.Dir(p.CompiledGoFiles[0])
+	}
+	return ""
 }
 
 // write writes p into destDir.
@@ -876,12 +1887,41 @@ func writePkg(p *packages.Package, destDir string) error {
 		return err
 	}
 
+	// OtherFiles include C, C++, assembly and header files used by cgo.
 	for _, fp := range p.OtherFiles {
 		if err := cp.Copy(fp, filepath.Join(destDir, filepath.Base(fp))); err != nil {
 			return fmt.Errorf("copy failed: %v", err)
 		}
 	}
 
+	// go:embed patterns may match files in subdirectories of the
+	// package, so keep the directory structure intact.
+	for _, fp := range p.EmbedFiles {
+		rel, err := filepath.Rel(pkgDir(p), fp)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			return fmt.Errorf("embedded file %s is not in package %s", fp, p.PkgPath)
+		}
+		dest := filepath.Join(destDir, rel)
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return err
+		}
+		if err := cp.Copy(fp, dest); err != nil {
+			return fmt.Errorf("copy failed: %v", err)
+		}
+	}
+
+	// Dependencies are copied verbatim; only commands are parsed.
+	//
+	// Syntax of cgo packages is cgo's output, but we want cgo to run on
+	// the original files again when the busybox is compiled.
+	if p.Syntax == nil || usesCgo(p) {
+		for _, fp := range p.GoFiles {
+			if err := cp.Copy(fp, filepath.Join(destDir, filepath.Base(fp))); err != nil {
+				return fmt.Errorf("copy failed: %v", err)
+			}
+		}
+		return nil
+	}
 	return writeFiles(destDir, p.Fset, p.Syntax)
 }
 
@@ -898,8 +1938,55 @@ func writeFiles(destDir string, fset *token.FileSet, files []*ast.File) error {
 	return nil
 }
 
+// sortSyntax sorts p's syntax trees by file name, which is the order in which
+// go build presents files to the compiler.
+//
+// The order of files determines the order in which init functions run, and in
+// which variables that do not depend on each other are initialized. If the
+// order changes, p is type-checked again to match TypesInfo.InitOrder to it.
+func sortSyntax(p *packages.Package) {
+	fileName := func(i int) string {
+		return filepath.Base(p.Fset.File(p.Syntax[i].Package).Name())
+	}
+	less := func(i, j int) bool {
+		return fileName(i) < fileName(j)
+	}
+	if sort.SliceIsSorted(p.Syntax, less) {
+		return
+	}
+	sort.SliceStable(p.Syntax, less)
+
+	info := &types.Info{
+		Types:      make(map[ast.Expr]types.TypeAndValue),
+		Defs:       make(map[*ast.Ident]types.Object),
+		Uses:       make(map[*ast.Ident]types.Object),
+		Implicits:  make(map[ast.Node]types.Object),
+		Selections: make(map[*ast.SelectorExpr]*types.Selection),
+		Scopes:     make(map[ast.Node]*types.Scope),
+	}
+	conf := types.Config{
+		Importer:    depsImporter(p),
+		FakeImportC: true,
+		// Errors were already reported when p was loaded.
+		Error: func(error) {},
+	}
+	p.Types, _ = conf.Check(p.PkgPath, p.Fset, p.Syntax, info)
+	p.TypesInfo = info
+}
+
 // Rewrite rewrites p into destDir as a bb package, creating an Init and Main function.
+//
+// Init runs all variable initializers in the order the Go spec defines before
+// calling the command's init functions in the order of their files, sorted by
+// name, just like the Go runtime initializes a package.
 func (p *Package) Rewrite(destDir string) error {
+	sortSyntax(p.Pkg)
+	if p.InterceptExit {
+		if err := p.checkExitNames(); err != nil {
+			return err
+		}
+	}
+
 	// This init holds all variable initializations.
 	//
 	// func Init0() {}
@@ -914,26 +2001,77 @@ func (p *Package) Rewrite(destDir string) error {
 
 	var mainFile *ast.File
 	for _, sourceFile := range p.Pkg.Syntax {
-		if hasMainFile := p.rewriteFile(sourceFile); hasMainFile {
+		hasMainFile, err := p.rewriteFile(sourceFile)
+		if err != nil {
+			return err
+		}
+		if hasMainFile {
 			mainFile = sourceFile
 		}
 	}
 	if mainFile == nil {
-		return fmt.Errorf("no main function found in package %q", p.Pkg.PkgPath)
+		return &RewriteError{
+			PkgPath: p.Pkg.PkgPath,
+			Err:     fmt.Errorf("no main function found"),
+		}
+	}
+
+	if err := p.checkKept(); err != nil {
+		return err
 	}
 
 	// Add variable initializations to Init0 in the right order.
 	for _, initStmt := range p.Pkg.TypesInfo.InitOrder {
+		if p.keptInit(initStmt) {
+			continue
+		}
 		a, ok := p.initAssigns[initStmt.Rhs]
 		if !ok {
-			return fmt.Errorf("couldn't find init assignment %s", initStmt)
+			return &RewriteError{
+				PkgPath: p.Pkg.PkgPath,
+				Pos:     p.Pkg.Fset.Position(initStmt.Rhs.Pos()),
+				Err:     fmt.Errorf("couldn't find init assignment %s", initStmt),
+			}
 		}
 		varInit.Body.List = append(varInit.Body.List, a)
 	}
+	// Initializers missing from InitOrder would silently not run.
+	if len(varInit.Body.List) != len(p.initAssigns) {
+		return &RewriteError{
+			PkgPath: p.Pkg.PkgPath,
+			Err:     fmt.Errorf("found %d global initializers, but the initialization order of only %d", len(p.initAssigns), len(varInit.Body.List)),
+		}
+	}
 
 	mainFile.Decls = append(mainFile.Decls, varInit, p.init)
 
-	return writePkg(p.Pkg, destDir)
+	// Exits are intercepted after moving initializers, whose expressions
+	// are the keys of initAssigns and InitOrder.
+	exitHelpers := make(map[string]exitHelper)
+	if p.InterceptExit {
+		for _, f := range p.Pkg.Syntax {
+			p.interceptExit(f, exitHelpers)
+		}
+	}
+
+	if err := writePkg(p.Pkg, destDir); err != nil {
+		return &RewriteError{PkgPath: p.Pkg.PkgPath, Err: err}
+	}
+	for _, f := range p.Pkg.Syntax {
+		if !p.raiseVersion[f] {
+			continue
+		}
+		path := filepath.Join(destDir, filepath.Base(p.Pkg.Fset.File(f.Package).Name()))
+		if err := raiseGoVersion(path, "go1.18"); err != nil {
+			return &RewriteError{PkgPath: p.Pkg.PkgPath, Err: err}
+		}
+	}
+	if p.InterceptExit {
+		if err := p.writeExitFile(destDir, exitHelpers); err != nil {
+			return &RewriteError{PkgPath: p.Pkg.PkgPath, Err: err}
+		}
+	}
+	return nil
 }
 
 func writeFile(path string, fset *token.FileSet, f *ast.File) error {
@@ -944,6 +2082,65 @@ func writeFile(path string, fset *token.FileSet, f *ast.File) error {
 	return writeGoFile(path, buf.Bytes())
 }
 
+// raiseGoVersion adds a build constraint on Go version v to the Go file at
+// path, which raises the file's language version to v if its module's is
+// lower. This works since Go 1.21. Existing build constraints of the file are
+// kept.
+func raiseGoVersion(path string, v string) error {
+	code, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, path, code, parser.PackageClauseOnly|parser.ParseComments)
+	if err != nil {
+		return err
+	}
+
+	// As for the go command, a //go:build line takes precedence over
+	// // +build lines, which are and-ed together.
+	var goBuild, plusBuild constraint.Expr
+	var remove []*ast.Comment
+	for _, cg := range f.Comments {
+		if cg.Pos() >= f.Package {
+			break
+		}
+		for _, c := range cg.List {
+			if !constraint.IsGoBuild(c.Text) && !constraint.IsPlusBuild(c.Text) {
+				continue
+			}
+			x, err := constraint.Parse(c.Text)
+			if err != nil {
+				return fmt.Errorf("%s: %v", fset.Position(c.Pos()), err)
+			}
+			if constraint.IsGoBuild(c.Text) {
+				goBuild = x
+			} else if plusBuild == nil {
+				plusBuild = x
+			} else {
+				plusBuild = &constraint.AndExpr{X: plusBuild, Y: x}
+			}
+			remove = append(remove, c)
+		}
+	}
+	var x constraint.Expr = &constraint.TagExpr{Tag: v}
+	if goBuild != nil {
+		x = &constraint.AndExpr{X: goBuild, Y: x}
+	} else if plusBuild != nil {
+		x = &constraint.AndExpr{X: plusBuild, Y: x}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "//go:build %s\n\n", x)
+	last := 0
+	for _, c := range remove {
+		buf.Write(code[last:fset.Position(c.Pos()).Offset])
+		last = fset.Position(c.End()).Offset
+	}
+	buf.Write(code[last:])
+	return writeGoFile(path, buf.Bytes())
+}
+
 func writeGoFile(path string, code []byte) error {
 	// Format the file. Do not fix up imports, as we only moved code around
 	// within files.
@@ -5,16 +5,245 @@
 package bb
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
 	"io/ioutil"
+	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
 	"testing"
 
 	"github.com/u-root/gobusybox/src/pkg/golang"
+	"golang.org/x/tools/go/packages"
 )
 
+// loadTestPackage parses and type-checks the Go files in dir the way
+// go/packages would, without requiring a go.mod.
+func loadTestPackage(t *testing.T, pkgPath, dir string, files ...string) *packages.Package {
+	t.Helper()
+
+	p := &packages.Package{
+		Name:    "main",
+		PkgPath: pkgPath,
+		Fset:    token.NewFileSet(),
+		TypesInfo: &types.Info{
+			Types:      make(map[ast.Expr]types.TypeAndValue),
+			Defs:       make(map[*ast.Ident]types.Object),
+			Uses:       make(map[*ast.Ident]types.Object),
+			Selections: make(map[*ast.SelectorExpr]*types.Selection),
+		},
+	}
+	for _, name := range files {
+		path := filepath.Join(dir, name)
+		f, err := parser.ParseFile(p.Fset, path, nil, parser.ParseComments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.GoFiles = append(p.GoFiles, path)
+		p.CompiledGoFiles = append(p.CompiledGoFiles, path)
+		p.Syntax = append(p.Syntax, f)
+	}
+
+	conf := types.Config{Importer: importer.Default()}
+	tpkg, err := conf.Check(pkgPath, p.Fset, p.Syntax, p.TypesInfo)
+	if err != nil {
+		t.Fatalf("type checking %s failed: %v", pkgPath, err)
+	}
+	p.Types = tpkg
+	return p
+}
+
+// buildTestBusybox builds a busybox of cmds, which map command names to the
+// source of their main.go, from the bbmain template and the extra files of
+// package main. Commands are rewritten with opts.InterceptExit, and their
+// synopses are added to opts.Synopses.
+func buildTestBusybox(t *testing.T, dir string, cmds map[string]string, opts *MainOpts, extra map[string]string) string {
+	t.Helper()
+	return buildTestBusyboxTemplate(t, dir, cmds, opts, bbMainTemplate, extra)
+}
+
+// buildTestBusyboxTemplate is like buildTestBusybox with the template files
+// tmpl.
+func buildTestBusyboxTemplate(t *testing.T, dir string, cmds map[string]string, opts *MainOpts, tmpl map[string][]byte, extra map[string]string) string {
+	t.Helper()
+
+	bbDir := filepath.Join(dir, "bb")
+	if opts.Synopses == nil {
+		opts.Synopses = make(map[string]string)
+	}
+	var pkgs []string
+	for name := range cmds {
+		src := filepath.Join(dir, "src", name)
+		writeTestFiles(t, src, map[string]string{"main.go": cmds[name]})
+		pkgPath := "example.com/cmd/" + name
+		p := loadTestPackage(t, pkgPath, src, "main.go")
+
+		opts.Synopses[name] = Synopsis(p.Syntax)
+		cmd := NewPackage(name, p)
+		cmd.InterceptExit = opts.InterceptExit
+		if err := cmd.Rewrite(filepath.Join(bbDir, "cmd", name)); err != nil {
+			t.Fatal(err)
+		}
+		pkgs = append(pkgs, pkgPath)
+	}
+	sort.Strings(pkgs)
+
+	if err := CreateBBMainSourceWithOpts(parseTestTemplate(t, tmpl), pkgs, bbDir, opts); err != nil {
+		t.Fatal(err)
+	}
+	extra["go.mod"] = "module example.com\n"
+	writeTestFiles(t, bbDir, extra)
+
+	bin := filepath.Join(dir, "bb.bin")
+	build := exec.Command("go", "build", "-o", bin, ".")
+	build.Dir = bbDir
+	build.Env = append(os.Environ(), "GO111MODULE=on", "GOFLAGS=-mod=mod", "GOPROXY=off")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("go build: %v\n%s", err, out)
+	}
+	return bin
+}
+
+// parseTestTemplate parses the template files tmpl.
+func parseTestTemplate(t *testing.T, tmpl map[string][]byte) *packages.Package {
+	t.Helper()
+
+	var names []string
+	for name := range tmpl {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	p := &packages.Package{Fset: token.NewFileSet()}
+	for _, name := range names {
+		f, err := parser.ParseFile(p.Fset, name, tmpl[name], parser.ParseComments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Syntax = append(p.Syntax, f)
+	}
+	return p
+}
+
+// runTestBusybox runs bin with args and additional environment variables,
+// and returns its exit code and combined output.
+func runTestBusybox(t *testing.T, bin string, env []string, args ...string) (int, string) {
+	t.Helper()
+
+	cmd := exec.Command(bin, args...)
+	cmd.Env = append(os.Environ(), env...)
+	var out strings.Builder
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := cmd.Run()
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), out.String()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return 0, out.String()
+}
+
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRewriteEmbed(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+	dir, err := ioutil.TempDir("", "test-embed-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	writeTestFiles(t, src, map[string]string{
+		"main.go": `package main
+
+import (
+	"embed"
+	"fmt"
+)
+
+//go:embed hello.txt
+var hello string
+
+var (
+	//go:embed static
+	static embed.FS
+
+	greeting = "hi"
+)
+
+func main() {
+	fmt.Println(greeting, hello, static)
+}
+`,
+		"hello.txt":        "hello",
+		"static/index.txt": "index",
+		"go.mod":           "module example.com/cmd/hello\n\ngo 1.16\n",
+	})
+
+	// The embedded files are only known if loadPkgs asks for them.
+	env := golang.Default()
+	env.GO111MODULE = "on"
+	pkgs, err := NewPackages(env, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkgs) != 1 {
+		t.Fatalf("NewPackages(%s) = %v, want one package", src, pkgs)
+	}
+
+	dest := filepath.Join(dir, "dest")
+	if err := pkgs[0].Rewrite(dest); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadFile(filepath.Join(dest, "main.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"//go:embed hello.txt\nvar hello string\n",
+		"\t//go:embed static\n\tstatic embed.FS\n",
+		"\tgreeting string\n",
+	} {
+		if !strings.Contains(string(got), want) {
+			t.Errorf("rewritten main.go does not contain %q:\n%s", want, got)
+		}
+	}
+
+	for _, name := range []string{"hello.txt", "static/index.txt"} {
+		if _, err := os.Stat(filepath.Join(dest, name)); err != nil {
+			t.Errorf("embedded file %s not copied: %v", name, err)
+		}
+	}
+}
+
 func DISABLEDTestPackageRewriteFile(t *testing.T) {
 	dir, err := ioutil.TempDir("", "u-root")
 	if err != nil {
@@ -34,6 +263,133 @@ func DISABLEDTestPackageRewriteFile(t *testing.T) {
 	}
 }
 
+func TestBuildBusyboxContext(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+	dir, err := ioutil.TempDir("", "test-build-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// greet is only a dependency, so it is typed from export data. The
+	// type of punct cannot be spelled out in hello, and it must not be
+	// initialized when bye runs, although the module predates generics.
+	writeTestFiles(t, dir, map[string]string{
+		"go.mod": "module example.com/m\n\ngo 1.16\n",
+		"greet/greet.go": `package greet
+
+import "fmt"
+
+func Greeting(name string) string {
+	return "hello " + name
+}
+
+type mark struct{ s string }
+
+func Mark(s string) *mark {
+	fmt.Println("mark")
+	return &mark{s}
+}
+
+func (m *mark) String() string { return m.s }
+`,
+		"cmd/hello/hello.go": `package main
+
+import (
+	"fmt"
+
+	"example.com/m/greet"
+)
+
+var (
+	greeting = greet.Greeting("world")
+	punct    = greet.Mark("!")
+)
+
+func main() {
+	fmt.Println(greeting + punct.String())
+}
+`,
+		"cmd/bye/bye.go": `package main
+
+import "fmt"
+
+func main() {
+	fmt.Println("bye")
+}
+`,
+	})
+
+	var loaded []string
+	bin := filepath.Join(dir, "bb")
+	opts := &Opts{
+		Env: golang.Default(),
+		CommandPaths: []string{
+			filepath.Join(dir, "cmd/hello"),
+			filepath.Join(dir, "cmd/bye"),
+		},
+		BinaryPath: bin,
+		Progress: func(e Event) {
+			if e.Phase == PhaseLoad && e.Command != "" {
+				loaded = append(loaded, e.Command)
+			}
+		},
+	}
+	if err := BuildBusyboxContext(context.Background(), opts); err != nil {
+		t.Fatalf("BuildBusyboxContext() = %v", err)
+	}
+
+	sort.Strings(loaded)
+	if want := []string{"example.com/m/cmd/bye", "example.com/m/cmd/hello"}; !reflect.DeepEqual(loaded, want) {
+		t.Errorf("loaded commands = %v, want %v", loaded, want)
+	}
+	for _, tt := range []struct {
+		cmd  string
+		want string
+	}{
+		{cmd: "hello", want: "mark\nhello world!\n"},
+		{cmd: "bye", want: "bye\n"},
+	} {
+		if code, out := runTestBusybox(t, bin, nil, tt.cmd); code != 0 || out != tt.want {
+			t.Errorf("bb %s = (%d, %q), want (0, %q)", tt.cmd, code, out, tt.want)
+		}
+	}
+}
+
+func TestBuildBusyboxContextCanceled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-canceled-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// BuildBusyboxContext creates its temporary directory in $TMPDIR.
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	opts := &Opts{
+		Env:          golang.Default(),
+		CommandPaths: []string{"github.com/u-root/gobusybox/src/cmd/helloworld"},
+		BinaryPath:   filepath.Join(dir, "bb"),
+	}
+	if err := BuildBusyboxContext(ctx, opts); !errors.Is(err, context.Canceled) {
+		t.Errorf("BuildBusyboxContext() = %v, want %v", err, context.Canceled)
+	}
+
+	leftovers, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range leftovers {
+		t.Errorf("BuildBusyboxContext() left %s behind", fi.Name())
+	}
+}
+
 func TestModules(t *testing.T) {
 	dir, err := ioutil.TempDir("", "test-modules-")
 	if err != nil {
@@ -90,3 +446,620 @@ func TestModules(t *testing.T) {
 		t.Errorf("modules() no module pkgs = %v, want %v", noModulePkgs, wantNoModule)
 	}
 }
+
+func TestRewriteCgo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-cgo-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	writeTestFiles(t, src, map[string]string{
+		"main.go": `package main
+
+// #include "hello.h"
+import "C"
+
+import "fmt"
+
+var (
+	answer C.int = 42
+	name         = "cgo"
+)
+
+func main() {
+	C.hello()
+	fmt.Println(name, answer)
+}
+`,
+		"hello.h": "void hello(void);\n",
+		"hello.c": "#include <stdio.h>\nvoid hello(void) { printf(\"hello\\n\"); }\n",
+	})
+
+	fmtPkg, err := importer.Default().Import("fmt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Resembles what go/packages returns for a cgo command.
+	p := &packages.Package{
+		Name:            "main",
+		PkgPath:         "example.com/cmd/hello",
+		GoFiles:         []string{filepath.Join(src, "main.go")},
+		CompiledGoFiles: []string{filepath.Join(dir, "cache/main.cgo1.go")},
+		OtherFiles:      []string{filepath.Join(src, "hello.c"), filepath.Join(src, "hello.h")},
+		Imports: map[string]*packages.Package{
+			"fmt": {PkgPath: "fmt", Types: fmtPkg},
+		},
+	}
+	if !usesCgo(p) {
+		t.Fatalf("usesCgo() = false, want true")
+	}
+	if err := parseGoFiles(p); err != nil {
+		t.Fatal(err)
+	}
+
+	dest := filepath.Join(dir, "dest")
+	if err := NewPackage("hello", p).Rewrite(dest); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadFile(filepath.Join(dest, "main.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"// #include \"hello.h\"\nimport \"C\"\n",
+		"answer C.int\n",
+		"name   string\n",
+		"func Main() {\n\tC.hello()\n",
+	} {
+		if !strings.Contains(string(got), want) {
+			t.Errorf("rewritten main.go does not contain %q:\n%s", want, got)
+		}
+	}
+	for _, name := range []string{"hello.c", "hello.h"} {
+		if _, err := os.Stat(filepath.Join(dest, name)); err != nil {
+			t.Errorf("cgo file %s not copied: %v", name, err)
+		}
+	}
+}
+
+func TestCheckDuplicate(t *testing.T) {
+	cmds := []*Package{
+		NewPackage("ls", &packages.Package{PkgPath: "github.com/u-root/u-root/cmds/core/ls"}),
+		NewPackage("cat", &packages.Package{PkgPath: "github.com/u-root/u-root/cmds/core/cat"}),
+		NewPackage("ls", &packages.Package{PkgPath: "github.com/u-root/u-bmc/cmd/ls"}),
+	}
+	err := checkDuplicate(cmds)
+
+	var dup *DuplicateCommandError
+	if !errors.As(err, &dup) {
+		t.Fatalf("checkDuplicate() = %v, want DuplicateCommandError", err)
+	}
+	want := &DuplicateCommandError{
+		Name:         "ls",
+		PkgPath:      "github.com/u-root/u-root/cmds/core/ls",
+		OtherPkgPath: "github.com/u-root/u-bmc/cmd/ls",
+	}
+	if !reflect.DeepEqual(dup, want) {
+		t.Errorf("checkDuplicate() = %#v, want %#v", dup, want)
+	}
+}
+
+func TestRewriteNoMain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-nomain-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTestFiles(t, dir, map[string]string{
+		"main.go": "package main\n\nfunc notMain() {}\n",
+	})
+	p := loadTestPackage(t, "example.com/cmd/nomain", dir, "main.go")
+
+	err = NewPackage("nomain", p).Rewrite(filepath.Join(dir, "dest"))
+	var rerr *RewriteError
+	if !errors.As(err, &rerr) {
+		t.Fatalf("Rewrite() = %v, want RewriteError", err)
+	}
+	if rerr.PkgPath != "example.com/cmd/nomain" {
+		t.Errorf("RewriteError.PkgPath = %q, want example.com/cmd/nomain", rerr.PkgPath)
+	}
+}
+
+func TestLocalModulesConflict(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-conflict-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTestFiles(t, dir, map[string]string{
+		"u-root/go.mod": "module github.com/u-root/u-root\n",
+		"u-bmc/go.mod":  "module github.com/u-root/u-bmc\n",
+	})
+	uroot := &packages.Module{
+		Path:  "github.com/u-root/u-root",
+		Dir:   filepath.Join(dir, "u-root"),
+		GoMod: filepath.Join(dir, "u-root/go.mod"),
+	}
+	ubmc := &packages.Module{
+		Path:  "github.com/u-root/u-bmc",
+		Dir:   filepath.Join(dir, "u-bmc"),
+		GoMod: filepath.Join(dir, "u-bmc/go.mod"),
+	}
+	remoteURoot := &packages.Module{
+		Path:    "github.com/u-root/u-root",
+		Version: "v6.0.0",
+		Dir:     "/go/pkg/mod/github.com/u-root/u-root@v6.0.0",
+	}
+
+	// u-bmc depends on a remote u-root in two packages, while u-root is
+	// also being compiled locally.
+	remoteDeps := map[string]*packages.Package{
+		"github.com/u-root/u-root/pkg/ls":  {ID: "github.com/u-root/u-root/pkg/ls", Module: remoteURoot},
+		"github.com/u-root/u-root/pkg/uio": {ID: "github.com/u-root/u-root/pkg/uio", Module: remoteURoot},
+	}
+	mainPkgs := []*Package{
+		NewPackage("ls", &packages.Package{ID: "github.com/u-root/u-root/cmds/core/ls", Module: uroot}),
+		NewPackage("fan", &packages.Package{ID: "github.com/u-root/u-bmc/cmd/fan", Module: ubmc, Imports: remoteDeps}),
+	}
+
+	_, err = localModules(filepath.Join(dir, "src"), mainPkgs)
+	var conflicts ModuleConflictErrors
+	if !errors.As(err, &conflicts) {
+		t.Fatalf("localModules() = %v, want ModuleConflictErrors", err)
+	}
+	want := ModuleConflictErrors{{
+		ModulePath:      "github.com/u-root/u-root",
+		Provenance:      "github.com/u-root/u-bmc uses version v6.0.0",
+		OtherProvenance: fmt.Sprintf("your request to compile github.com/u-root/u-root from %s uses directory %s", uroot.Dir, uroot.Dir),
+		Replace:         "replace github.com/u-root/u-root => ../u-root",
+		GoMod:           ubmc.GoMod,
+	}}
+	if !reflect.DeepEqual(conflicts, want) {
+		t.Errorf("localModules() = %v, want %v", conflicts, want)
+	}
+}
+
+func TestNotCommand(t *testing.T) {
+	for _, tt := range []struct {
+		p    *packages.Package
+		want error
+	}{
+		{
+			p:    &packages.Package{ID: "example.com/cmd/ls", Name: "main", GoFiles: []string{"ls.go"}},
+			want: nil,
+		},
+		{
+			p:    &packages.Package{ID: "example.com/cmd/empty"},
+			want: &NotCommandError{ID: "example.com/cmd/empty", Reason: "it has no Go files"},
+		},
+		{
+			p:    &packages.Package{ID: "example.com/pkg/ls", Name: "ls", GoFiles: []string{"ls.go"}},
+			want: &NotCommandError{ID: "example.com/pkg/ls", Reason: "it is not a command (must be `package main`)"},
+		},
+		{
+			p: &packages.Package{ID: "./cmd/typo", Errors: []packages.Error{{Msg: "directory not found"}}},
+			want: &LoadError{
+				PkgPath: "./cmd/typo",
+				Errors:  []PackageError{{PkgPath: "./cmd/typo", Err: packages.Error{Msg: "directory not found"}}},
+			},
+		},
+		{
+			p: &packages.Package{
+				ID:      "example.com/cmd/ls",
+				PkgPath: "example.com/cmd/ls",
+				Name:    "main",
+				GoFiles: []string{"ls.go"},
+				Errors:  []packages.Error{{Msg: "ls is broken"}},
+				Imports: map[string]*packages.Package{
+					"example.com/pkg/ls": {
+						ID:      "example.com/pkg/ls",
+						PkgPath: "example.com/pkg/ls",
+						Errors:  []packages.Error{{Msg: "pkg is broken"}},
+					},
+				},
+			},
+			want: &LoadError{
+				PkgPath: "example.com/cmd/ls",
+				Errors: []PackageError{
+					{PkgPath: "example.com/pkg/ls", Err: packages.Error{Msg: "pkg is broken"}},
+					{PkgPath: "example.com/cmd/ls", Err: packages.Error{Msg: "ls is broken"}},
+				},
+			},
+		},
+	} {
+		if got := notCommand(tt.p); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("notCommand(%s) = %v, want %v", tt.p.ID, got, tt.want)
+		}
+	}
+}
+
+func TestLoadError(t *testing.T) {
+	p := &packages.Package{
+		ID:      "example.com/cmd/ls",
+		PkgPath: "example.com/cmd/ls",
+		Errors:  []packages.Error{{Pos: "ls.go:1:1", Msg: "ls is broken"}},
+		Imports: map[string]*packages.Package{
+			"example.com/pkg/ls": {
+				ID:      "example.com/pkg/ls",
+				PkgPath: "example.com/pkg/ls",
+				Errors:  []packages.Error{{Pos: "pkg.go:2:1", Msg: "pkg is broken"}},
+			},
+		},
+	}
+	err := fmt.Errorf("loading: %w", packageErrors(p))
+
+	var le *LoadError
+	if !errors.As(err, &le) {
+		t.Fatalf("errors.As(%v, *LoadError) = false, want true", err)
+	}
+	want := "package example.com/cmd/ls has errors:\n\tin package example.com/pkg/ls: pkg.go:2:1: pkg is broken\n\tls.go:1:1: ls is broken"
+	if got := le.Error(); got != want {
+		t.Errorf("LoadError = %q, want %q", got, want)
+	}
+	var pe packages.Error
+	if !errors.As(le.Errors[0], &pe) || pe.Msg != "pkg is broken" {
+		t.Errorf("errors.As(%v, packages.Error) = %v, want pkg is broken", le.Errors[0], pe)
+	}
+}
+
+// TestNewPackagesStrict checks that in strict mode, only requested paths that
+// yield no command or fail to load fail.
+func TestNewPackagesStrict(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+	dir, err := ioutil.TempDir("", "test-strict-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestFiles(t, dir, map[string]string{
+		"go.mod":         "module example.com/m\n\ngo 1.18\n",
+		"cmd/ls/ls.go":   "package main\n\nfunc main() {}\n",
+		"cmd/util/u.go":  "package util\n",
+		"pkg/lib/lib.go": "package lib\n",
+	})
+	env := golang.Default()
+	env.GO111MODULE = "on"
+
+	for _, tt := range []struct {
+		names    []string
+		wantCmds []string
+		// want are the IDs of the skipped packages in the error.
+		want []string
+		// warned are the packages skipped with a warning.
+		warned []string
+	}{
+		{
+			names:    []string{"./cmd/..."},
+			wantCmds: []string{"example.com/m/cmd/ls"},
+			warned:   []string{"example.com/m/cmd/util"},
+		},
+		{
+			names:    []string{"./cmd/ls", "./cmd/..."},
+			wantCmds: []string{"example.com/m/cmd/ls"},
+			warned:   []string{"example.com/m/cmd/util"},
+		},
+		{
+			names: []string{"./cmd/ls", "./pkg/lib"},
+			want:  []string{"example.com/m/pkg/lib"},
+		},
+		{
+			names: []string{"./cmd/ls", "./pkg/..."},
+			want:  []string{"example.com/m/pkg/lib"},
+		},
+		{
+			names: []string{"./cmd/...", "./cmd/typo"},
+			want:  []string{"./cmd/typo"},
+		},
+		{
+			names: []string{"./cmd/ls", "./none/..."},
+			want:  []string{"./none/..."},
+		},
+	} {
+		var paths []string
+		for _, name := range tt.names {
+			paths = append(paths, filepath.Join(dir, name))
+		}
+		var logs bytes.Buffer
+		r := newReporter(&Opts{Logger: NewLogger(log.New(&logs, "", 0), LevelWarning)})
+		cmds, err := newPackages(context.Background(), r, env, 0, true, paths...)
+
+		var got []string
+		var skipped SkippedPackagesError
+		if errors.As(err, &skipped) {
+			for _, err := range skipped {
+				var le *LoadError
+				var nce *NotCommandError
+				if errors.As(err, &le) {
+					got = append(got, le.PkgPath)
+				} else if errors.As(err, &nce) {
+					got = append(got, nce.ID)
+				}
+			}
+		} else if err != nil {
+			t.Fatalf("newPackages(%v) = %v", tt.names, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("newPackages(%v) skipped %v, want %v (%v)", tt.names, got, tt.want, err)
+		}
+		if tt.want != nil {
+			continue
+		}
+
+		var gotCmds []string
+		for _, cmd := range cmds {
+			gotCmds = append(gotCmds, cmd.Pkg.PkgPath)
+		}
+		if !reflect.DeepEqual(gotCmds, tt.wantCmds) {
+			t.Errorf("newPackages(%v) = %v, want %v", tt.names, gotCmds, tt.wantCmds)
+		}
+		for _, pkg := range tt.warned {
+			if !strings.Contains(logs.String(), "Skipping package "+pkg) {
+				t.Errorf("newPackages(%v) logged %q, want a warning about %s", tt.names, logs.String(), pkg)
+			}
+		}
+	}
+}
+
+// TestBusyboxDispatch checks which command the busybox runs, depending on
+// argv, the default command and CmdEnv.
+func TestBusyboxDispatch(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+
+	cmds := make(map[string]string)
+	for _, name := range []string{"echo", "sh"} {
+		cmds[name] = fmt.Sprintf(`package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func main() {
+	fmt.Printf("%s %%q %%q\n", os.Args[1:], os.Getenv("BB_CMD"))
+}
+`, name)
+	}
+
+	// Busyboxes by default command.
+	bins := make(map[string]string)
+	for _, tt := range []struct {
+		defaultCmd string
+		env        []string
+		args       []string
+		wantCode   int
+		want       string
+	}{
+		{args: []string{"echo", "a"}, want: `echo ["a"] ""` + "\n"},
+		{args: []string{}, wantCode: 1, want: "Invalid busybox command"},
+		{args: []string{"nope"}, wantCode: 1, want: "Invalid busybox command"},
+		{env: []string{"BB_CMD=echo"}, args: []string{"a"}, want: `echo ["a"] ""` + "\n"},
+		{env: []string{"BB_CMD=nope"}, args: []string{"echo"}, wantCode: 1, want: `BB_CMD "nope": command not registered`},
+		{defaultCmd: "sh", args: []string{}, want: `sh [] ""` + "\n"},
+		{defaultCmd: "sh", args: []string{"-c", "echo"}, want: `sh ["-c" "echo"] ""` + "\n"},
+		{defaultCmd: "sh", args: []string{"echo", "a"}, want: `echo ["a"] ""` + "\n"},
+		{defaultCmd: "sh", env: []string{"BB_CMD=echo"}, args: []string{"sh"}, want: `echo ["sh"] ""` + "\n"},
+	} {
+		bin, ok := bins[tt.defaultCmd]
+		if !ok {
+			dir, err := ioutil.TempDir("", "test-dispatch-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			bin = buildTestBusybox(t, dir, cmds, &MainOpts{DefaultCommand: tt.defaultCmd}, map[string]string{})
+			bins[tt.defaultCmd] = bin
+		}
+		code, out := runTestBusybox(t, bin, tt.env, tt.args...)
+		if code != tt.wantCode || !strings.Contains(out, tt.want) {
+			t.Errorf("DefaultCmd=%q: %v bb %v = (%d, %q), want (%d, %q)", tt.defaultCmd, tt.env, tt.args, code, out, tt.wantCode, tt.want)
+		}
+	}
+}
+
+// TestBusyboxAliases checks that commands are registered by their names and
+// aliases.
+func TestBusyboxAliases(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+	dir, err := ioutil.TempDir("", "test-aliases-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cmds := make(map[string]string)
+	for _, name := range []string{"echo", "sh"} {
+		cmds[name] = fmt.Sprintf(`package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func main() {
+	fmt.Printf("%s %%q\n", os.Args[1:])
+}
+`, name)
+	}
+	opts := &MainOpts{
+		Names:          map[string]string{"example.com/cmd/sh": "ash"},
+		Aliases:        map[string]string{"[": "echo", "bash": "ash"},
+		DefaultCommand: "bash",
+	}
+	bin := buildTestBusybox(t, dir, cmds, opts, map[string]string{})
+
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{args: []string{"ash", "-c"}, want: `sh ["-c"]` + "\n"},
+		{args: []string{"bash", "-c"}, want: `sh ["-c"]` + "\n"},
+		{args: []string{"[", "x"}, want: `echo ["x"]` + "\n"},
+		// sh is not a command anymore, so the default command runs.
+		{args: []string{"sh"}, want: `sh ["sh"]` + "\n"},
+		{args: []string{"help"}, want: "[               alias for echo\n"},
+	} {
+		if code, out := runTestBusybox(t, bin, nil, tt.args...); code != 0 || !strings.Contains(out, tt.want) {
+			t.Errorf("bb %v = (%d, %q), want (0, %q)", tt.args, code, out, tt.want)
+		}
+	}
+
+	// Aliases dispatch on argv[0], e.g. as symlinks.
+	link := filepath.Join(dir, "bash")
+	if err := os.Symlink(bin, link); err != nil {
+		t.Fatal(err)
+	}
+	if code, out := runTestBusybox(t, link, nil, "a"); code != 0 || out != `sh ["a"]`+"\n" {
+		t.Errorf("bash a = (%d, %q), want (0, %q)", code, out, `sh ["a"]`+"\n")
+	}
+}
+
+// TestBusyboxHelp checks the busybox's help command and suggestions for
+// unknown commands.
+func TestBusyboxHelp(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+
+	dir, err := ioutil.TempDir("", "test-help-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bin := buildTestBusybox(t, dir, map[string]string{
+		"ls": `// Ls lists files. It is not a real ls.
+package main
+
+import "flag"
+
+var long = flag.Bool("l", false, "long listing")
+
+func main() {
+	flag.Parse()
+}
+`,
+		"cat": `package main
+
+func main() {}
+`,
+	}, &MainOpts{}, map[string]string{})
+
+	for _, tt := range []struct {
+		args     []string
+		wantCode int
+		want     string
+	}{
+		{
+			args: []string{"help"},
+			want: "bbdiagnose      lists commands without /bbin symlinks and /bbin symlinks without commands\n" +
+				"cat\n" +
+				"ls              Ls lists files.\n",
+		},
+		{args: []string{"help", "ls"}, want: "long listing"},
+		{args: []string{"help", "lss"}, wantCode: 1, want: `help "lss": command not registered; did you mean "ls"?; run "bb.bin help" for a list of commands`},
+		{args: []string{"lss"}, wantCode: 1, want: `Invalid busybox command: ["lss"]; did you mean "ls"?; run "bb.bin help" for a list of commands`},
+		{args: []string{"ct"}, wantCode: 1, want: `did you mean "cat"?;`},
+		{args: []string{"xyz"}, wantCode: 1, want: `Invalid busybox command: ["xyz"]; run "bb.bin help" for a list of commands`},
+	} {
+		code, out := runTestBusybox(t, bin, nil, tt.args...)
+		if code != tt.wantCode || !strings.Contains(out, tt.want) {
+			t.Errorf("bb %v = (%d, %q), want (%d, %q)", tt.args, code, out, tt.wantCode, tt.want)
+		}
+	}
+}
+
+func TestCreateBBMainSourceDefaultCommand(t *testing.T) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "main.go", bbMainTemplate["main.go"], parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "test-defaultcmd-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := &packages.Package{Fset: fset, Syntax: []*ast.File{f}}
+	err = CreateBBMainSourceWithOpts(p, []string{"example.com/cmd/ls"}, dir, &MainOpts{DefaultCommand: "sh"})
+	if err == nil || !strings.Contains(err.Error(), `default command "sh" is not one of the commands`) {
+		t.Errorf("CreateBBMainSourceWithOpts = %v, want error about default command", err)
+	}
+}
+
+func TestCreateBBMainSourceNameErrors(t *testing.T) {
+	pkgs := []string{"example.com/cmd/ls", "example.com/other/ls", "example.com/cmd/cat"}
+	for _, tt := range []struct {
+		opts *MainOpts
+		want string
+	}{
+		{
+			opts: &MainOpts{},
+			want: `two commands are named "ls"`,
+		},
+		{
+			opts: &MainOpts{Names: map[string]string{"example.com/other/ls": "cat"}},
+			want: `two commands are named "cat"`,
+		},
+		{
+			opts: &MainOpts{
+				Names:   map[string]string{"example.com/other/ls": "ls2"},
+				Aliases: map[string]string{"cat": "ls"},
+			},
+			want: `alias "cat" is also the name of a command`,
+		},
+		{
+			opts: &MainOpts{
+				Names:   map[string]string{"example.com/other/ls": "ls2"},
+				Aliases: map[string]string{"dir": "sh"},
+			},
+			want: `alias "dir" is for "sh", which is not one of the commands`,
+		},
+		{
+			opts: &MainOpts{
+				Names:          map[string]string{"example.com/other/ls": "ls2"},
+				Aliases:        map[string]string{"dir": "ls"},
+				DefaultCommand: "sh",
+			},
+			want: `default command "sh" is not one of the commands`,
+		},
+		{
+			opts: &MainOpts{
+				Names:          map[string]string{"example.com/other/ls": "ls2"},
+				Aliases:        map[string]string{"dir": "ls"},
+				DefaultCommand: "dir",
+			},
+		},
+	} {
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, "main.go", bbMainTemplate["main.go"], parser.ParseComments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir, err := ioutil.TempDir("", "test-names-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		p := &packages.Package{Fset: fset, Syntax: []*ast.File{f}}
+		err = CreateBBMainSourceWithOpts(p, pkgs, dir, tt.opts)
+		if tt.want == "" && err != nil {
+			t.Errorf("CreateBBMainSourceWithOpts(%+v) = %v, want nil", tt.opts, err)
+		} else if tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)) {
+			t.Errorf("CreateBBMainSourceWithOpts(%+v) = %v, want error %q", tt.opts, err, tt.want)
+		}
+	}
+}
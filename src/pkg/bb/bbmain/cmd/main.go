@@ -162,10 +162,53 @@ func RegisterDefault(init, main func()) {
 	}
 }
 
+var exitHooks []func(code int)
+
+// AddExitHook registers f to be called with the exit code before the busybox
+// exits, e.g. to flush buffers or restore terminal state.
+//
+// Hooks run when a command returns from main, and when a command rewritten
+// with exit interception calls os.Exit, log.Fatal or a similar function.
+func AddExitHook(f func(code int)) {
+	exitHooks = append(exitHooks, f)
+}
+
+// ExitPanics makes Exit panic instead of exiting. Run recovers the panic, so
+// that the deferred functions of the command's main run before the busybox
+// exits.
+//
+// Exits from goroutines other than the one running main still crash the
+// busybox, because their panics cannot be recovered by Run. A command that
+// calls recover() itself, e.g. to turn panics into errors, also recovers the
+// panic of an exit, which then does not exit the command at all.
+var ExitPanics bool
+
+// exitPanic is the panic of Exit if ExitPanics is set.
+type exitPanic struct {
+	code int
+}
+
+// Exit exits the busybox with the given code after calling the exit hooks.
+//
+// Commands rewritten with exit interception call Exit instead of os.Exit.
+func Exit(code int) {
+	if ExitPanics {
+		panic(exitPanic{code})
+	}
+	exit(code)
+}
+
+func exit(code int) {
+	for _, f := range exitHooks {
+		f(code)
+	}
+	os.Exit(code)
+}
+
 // Run runs the command with the given name.
 //
 // If the command's main exits without calling os.Exit, Run will exit with exit
-// code 0.
+// code 0 after calling the exit hooks.
 func Run(name string) error {
 	var cmd *bbCmd
 	if c, ok := bbCmds[name]; ok {
@@ -175,13 +218,148 @@ func Run(name string) error {
 	} else {
 		return ErrNotRegistered
 	}
+	defer func() {
+		// Recover exits only, and let all other panics crash.
+		switch r := recover().(type) {
+		case nil:
+		case exitPanic:
+			exit(r.code)
+		default:
+			panic(r)
+		}
+	}()
 	cmd.init()
 	cmd.main()
-	os.Exit(0)
+	exit(0)
 	// Unreachable.
 	return nil
 }
 
+// CmdEnv is the environment variable that, if set, names the command to run
+// instead of argv[0]. It is useful in containers, where argv[0] is fixed.
+//
+// CmdEnv is removed from the environment before the command runs, so that
+// processes it starts dispatch on their own argv[0].
+const CmdEnv = "BB_CMD"
+
+// DefaultCmd is run with unchanged arguments if neither argv[0] nor argv[1]
+// name a command, e.g. to run init when the busybox is PID 1, or to fall back
+// to a shell. If empty, such invocations fail.
+var DefaultCmd string
+
+// progName is the base name of the busybox binary, for messages.
+var progName = "bb"
+
+var synopses = map[string]string{}
+
+// RegisterSynopsis registers a one-line description of the command name, which
+// the help command lists.
+func RegisterSynopsis(name, synopsis string) {
+	synopses[name] = synopsis
+}
+
+// RegisterAlias registers alias as another name of the registered command
+// name.
+func RegisterAlias(alias, name string) {
+	cmd, ok := bbCmds[name]
+	if !ok {
+		panic(fmt.Sprintf("cannot register alias %q for unregistered command %q", alias, name))
+	}
+	Register(alias, cmd.init, cmd.main)
+	synopses[alias] = "alias for " + name
+}
+
+// sortedCmds returns the names of all commands in order. They are sorted by
+// insertion rather than with package sort, to keep the binary small.
+func sortedCmds() []string {
+	var names []string
+	for name := range bbCmds {
+		names = append(names, name)
+		for i := len(names) - 1; i > 0 && names[i] < names[i-1]; i-- {
+			names[i], names[i-1] = names[i-1], names[i]
+		}
+	}
+	return names
+}
+
+// distance returns the edit distance between a and b.
+func distance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			d := prev[j-1]
+			if a[i-1] != b[j-1] {
+				d++
+			}
+			if prev[j]+1 < d {
+				d = prev[j] + 1
+			}
+			if cur[j-1]+1 < d {
+				d = cur[j-1] + 1
+			}
+			cur[j] = d
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// suggest returns the commands closest to name, if any are close enough to be
+// a typo of it.
+func suggest(name string) []string {
+	best := 2
+	if len(name) <= 3 {
+		best = 1
+	}
+	var names []string
+	for _, cmd := range sortedCmds() {
+		switch d := distance(name, cmd); {
+		case d < best:
+			best, names = d, []string{cmd}
+		case d == best:
+			names = append(names, cmd)
+		}
+	}
+	return names
+}
+
+// notRegistered exits the busybox because name does not name a command.
+func notRegistered(msg, name string) {
+	if names := suggest(name); len(names) > 0 {
+		msg += "; did you mean"
+		for i, n := range names {
+			if i > 0 {
+				msg += " or"
+			}
+			msg += fmt.Sprintf(" %q", n)
+		}
+		msg += "?"
+	}
+	log.Fatalf("%s; run %q for a list of commands", msg, progName+" help")
+}
+
+// help lists all commands with their synopses if args is empty, and runs the
+// command args[0] with -h otherwise.
+func help(args []string) {
+	if len(args) == 0 {
+		for _, name := range sortedCmds() {
+			if synopsis := synopses[name]; synopsis != "" {
+				fmt.Printf("%-15s %s\n", name, synopsis)
+			} else {
+				fmt.Println(name)
+			}
+		}
+		exit(0)
+	}
+	os.Args = []string{args[0], "-h"}
+	runRegistered(args[0], "help")
+}
+
 func run() {
 	name := filepath.Base(os.Args[0])
 	if err := Run(name); err != nil {
@@ -189,21 +367,47 @@ func run() {
 	}
 }
 
+// runRegistered runs the registered command name, without falling back to the
+// default command.
+func runRegistered(name, what string) {
+	if _, ok := bbCmds[name]; !ok {
+		notRegistered(fmt.Sprintf("%s %q: %v", what, name, ErrNotRegistered), name)
+	}
+	if err := Run(name); err != nil {
+		log.Fatalf("%s: %v", name, err)
+	}
+}
+
 func main() {
 	os.Args[0] = ResolveUntilLastSymlink(os.Args[0])
+	progName = filepath.Base(os.Args[0])
 
+	if name := os.Getenv(CmdEnv); name != "" {
+		os.Unsetenv(CmdEnv)
+		runRegistered(name, CmdEnv)
+	}
 	run()
 }
 
 func init() {
 	m := func() {
-		if len(os.Args) == 1 {
-			log.Fatalf("Invalid busybox command: %q", os.Args)
+		if len(os.Args) > 1 {
+			// Commands named help take precedence.
+			if _, ok := bbCmds["help"]; !ok && os.Args[1] == "help" {
+				help(os.Args[2:])
+			}
+			if _, ok := bbCmds[filepath.Base(os.Args[1])]; ok || DefaultCmd == "" {
+				// Use argv[1] as the name.
+				os.Args = os.Args[1:]
+				run()
+			}
+		}
+		if DefaultCmd == "" {
+			notRegistered(fmt.Sprintf("Invalid busybox command: %q", os.Args), filepath.Base(os.Args[0]))
 		}
-		// Use argv[1] as the name.
-		os.Args = os.Args[1:]
-		run()
+		runRegistered(DefaultCmd, "default command")
 	}
 	Register("bbdiagnose", Noop, ListCmds)
+	RegisterSynopsis("bbdiagnose", "lists commands without /bbin symlinks and /bbin symlinks without commands")
 	RegisterDefault(Noop, m)
 }
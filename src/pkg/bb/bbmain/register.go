@@ -2,8 +2,12 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// Package bbmain is the package imported by all rewritten busybox
-// command-packages to register themselves.
+// Package bbmain has the command registry of the busybox main.go template in
+// bbmain/cmd, for programs that register and run commands themselves.
+//
+// It is not the dispatcher of busyboxes: their main package is generated from
+// bbmain/cmd, which also picks the command from argv, BB_CMD or DefaultCmd and
+// has the help command. Rewritten commands do not import bbmain.
 package bbmain
 
 import (
@@ -113,10 +117,77 @@ func RegisterDefault(init, main func()) {
 	}
 }
 
+var synopses = map[string]string{}
+
+// RegisterSynopsis registers a one-line description of the command name.
+func RegisterSynopsis(name, synopsis string) {
+	synopses[name] = synopsis
+}
+
+// Synopsis returns the description of the command name registered with
+// RegisterSynopsis or RegisterAlias, if any.
+func Synopsis(name string) string {
+	return synopses[name]
+}
+
+// RegisterAlias registers alias as another name of the registered command
+// name.
+func RegisterAlias(alias, name string) {
+	cmd, ok := bbCmds[name]
+	if !ok {
+		panic(fmt.Sprintf("cannot register alias %q for unregistered command %q", alias, name))
+	}
+	Register(alias, cmd.init, cmd.main)
+	synopses[alias] = "alias for " + name
+}
+
+var exitHooks []func(code int)
+
+// AddExitHook registers f to be called with the exit code before the busybox
+// exits, e.g. to flush buffers or restore terminal state.
+//
+// Hooks run when a command returns from main, and when a command rewritten
+// with exit interception calls os.Exit, log.Fatal or a similar function.
+func AddExitHook(f func(code int)) {
+	exitHooks = append(exitHooks, f)
+}
+
+// ExitPanics makes Exit panic instead of exiting. Run recovers the panic, so
+// that the deferred functions of the command's main run before the busybox
+// exits.
+//
+// Exits from goroutines other than the one running main still crash the
+// busybox, because their panics cannot be recovered by Run. A command that
+// calls recover() itself, e.g. to turn panics into errors, also recovers the
+// panic of an exit, which then does not exit the command at all.
+var ExitPanics bool
+
+// exitPanic is the panic of Exit if ExitPanics is set.
+type exitPanic struct {
+	code int
+}
+
+// Exit exits the busybox with the given code after calling the exit hooks.
+//
+// Commands rewritten with exit interception call Exit instead of os.Exit.
+func Exit(code int) {
+	if ExitPanics {
+		panic(exitPanic{code})
+	}
+	exit(code)
+}
+
+func exit(code int) {
+	for _, f := range exitHooks {
+		f(code)
+	}
+	os.Exit(code)
+}
+
 // Run runs the command with the given name.
 //
 // If the command's main exits without calling os.Exit, Run will exit with exit
-// code 0.
+// code 0 after calling the exit hooks.
 func Run(name string) error {
 	var cmd *bbCmd
 	if c, ok := bbCmds[name]; ok {
@@ -126,9 +197,19 @@ func Run(name string) error {
 	} else {
 		return ErrNotRegistered
 	}
+	defer func() {
+		// Recover exits only, and let all other panics crash.
+		switch r := recover().(type) {
+		case nil:
+		case exitPanic:
+			exit(r.code)
+		default:
+			panic(r)
+		}
+	}()
 	cmd.init()
 	cmd.main()
-	os.Exit(0)
+	exit(0)
 	// Unreachable.
 	return nil
 }
@@ -0,0 +1,185 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package bbtest checks that commands behave the same when compiled into a
+// busybox as when compiled standalone.
+//
+// The busybox rewrite moves global initialization into functions and calls
+// them from a shared main, which subtly changes behavior when it goes wrong,
+// e.g. if variables are initialized in a different order. Verify catches
+// that by running user-supplied cases against both binaries and comparing
+// the results.
+package bbtest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/u-root/gobusybox/src/pkg/bb"
+	"github.com/u-root/gobusybox/src/pkg/golang"
+)
+
+// Result is the observable outcome of running a command.
+type Result struct {
+	ExitCode int
+	Stdout   string
+	Stderr   string
+}
+
+// Mismatch is a case for which the standalone command and the busybox
+// command behaved differently.
+type Mismatch struct {
+	Case       Case
+	Standalone Result
+	Busybox    Result
+}
+
+// Error implements error.
+func (m *Mismatch) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "command %s, case %q differs between standalone and busybox:", m.Case.Command, m.Case.Name)
+	if m.Standalone.ExitCode != m.Busybox.ExitCode {
+		fmt.Fprintf(&b, "\n  exit code: standalone %d, busybox %d", m.Standalone.ExitCode, m.Busybox.ExitCode)
+	}
+	if m.Standalone.Stdout != m.Busybox.Stdout {
+		fmt.Fprintf(&b, "\n  stdout: standalone %q, busybox %q", m.Standalone.Stdout, m.Busybox.Stdout)
+	}
+	if m.Standalone.Stderr != m.Busybox.Stderr {
+		fmt.Fprintf(&b, "\n  stderr: standalone %q, busybox %q", m.Standalone.Stderr, m.Busybox.Stderr)
+	}
+	return b.String()
+}
+
+// compare returns a Mismatch if the results differ, or nil if they are the
+// same.
+func compare(c Case, standalone, busybox *Result) *Mismatch {
+	if *standalone == *busybox {
+		return nil
+	}
+	return &Mismatch{Case: c, Standalone: *standalone, Busybox: *busybox}
+}
+
+// run runs c with the binary bin in the empty directory workDir.
+//
+// argv[0] is always c.Command, so that busybox binaries dispatch to the
+// right command and both binaries print the same usage messages.
+func run(ctx context.Context, bin, workDir string, c Case) (*Result, error) {
+	if err := os.RemoveAll(workDir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(workDir, 0755); err != nil {
+		return nil, err
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, bin, c.Args...)
+	cmd.Args[0] = c.Command
+	cmd.Dir = workDir
+	cmd.Env = append(os.Environ(), c.Env...)
+	cmd.Stdin = strings.NewReader(c.Stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	r := &Result{}
+	var exitErr *exec.ExitError
+	if err := cmd.Run(); ctx.Err() != nil {
+		return nil, ctx.Err()
+	} else if errors.As(err, &exitErr) {
+		r.ExitCode = exitErr.ExitCode()
+	} else if err != nil {
+		return nil, fmt.Errorf("running %s: %v", bin, err)
+	}
+	r.Stdout = stdout.String()
+	r.Stderr = stderr.String()
+	return r, nil
+}
+
+// Verify builds the busybox described by opts and every command that cases
+// refer to standalone, runs each case against both, and returns the cases
+// for which they behaved differently.
+//
+// opts.BinaryPath is ignored; binaries are built in a temporary directory.
+// Each case runs in a new empty working directory with the case's input.
+// Output that varies between runs, e.g. timestamps, makes cases fail.
+func Verify(ctx context.Context, opts *bb.Opts, cases []Case) ([]*Mismatch, error) {
+	logf := func(format string, v ...interface{}) {
+		if opts.Logger != nil {
+			opts.Logger.Logf(bb.LevelInfo, format, v...)
+		}
+	}
+
+	tmpDir, err := ioutil.TempDir("", "bbtest-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	bbOpts := *opts
+	bbOpts.BinaryPath = filepath.Join(tmpDir, "bb")
+	logf("Building busybox")
+	if err := bb.BuildBusyboxContext(ctx, &bbOpts); err != nil {
+		return nil, err
+	}
+
+	// Find the source directory of every command in the busybox.
+	paths := append(append([]string{}, opts.CommandPaths...), opts.OptionalCommandPaths...)
+	cmds, err := bb.NewPackagesWithOpts(opts.Env, &bb.PackagesOpts{Logger: opts.Logger}, paths...)
+	if err != nil {
+		return nil, err
+	}
+	dirs := make(map[string]string)
+	for _, cmd := range cmds {
+		dirs[cmd.Name] = filepath.Dir(cmd.Pkg.GoFiles[0])
+	}
+
+	// Aliases run the standalone binary of their command.
+	command := func(c Case) string {
+		if name, ok := opts.Aliases[c.Command]; ok {
+			return name
+		}
+		return c.Command
+	}
+
+	standalone := make(map[string]string)
+	for _, c := range cases {
+		name := command(c)
+		if _, ok := standalone[name]; ok {
+			continue
+		}
+		dir, ok := dirs[name]
+		if !ok {
+			return nil, fmt.Errorf("case %q: command %q is not in the busybox", c.Name, c.Command)
+		}
+		bin := filepath.Join(tmpDir, "standalone", name)
+		logf("Building %s standalone", name)
+		if err := opts.Env.BuildDirContext(ctx, dir, bin, golang.BuildOpts{NoStrip: opts.NoStrip}); err != nil {
+			return nil, err
+		}
+		standalone[name] = bin
+	}
+
+	var mismatches []*Mismatch
+	workDir := filepath.Join(tmpDir, "work")
+	for _, c := range cases {
+		s, err := run(ctx, standalone[command(c)], workDir, c)
+		if err != nil {
+			return nil, fmt.Errorf("case %q: %w", c.Name, err)
+		}
+		b, err := run(ctx, bbOpts.BinaryPath, workDir, c)
+		if err != nil {
+			return nil, fmt.Errorf("case %q: %w", c.Name, err)
+		}
+		if m := compare(c, s, b); m != nil {
+			mismatches = append(mismatches, m)
+		}
+	}
+	return mismatches, nil
+}
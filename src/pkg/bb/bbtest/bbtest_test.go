@@ -0,0 +1,148 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bbtest
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/u-root/gobusybox/src/pkg/bb"
+	"github.com/u-root/gobusybox/src/pkg/golang"
+)
+
+func TestParseCases(t *testing.T) {
+	cases, err := ParseCases(strings.NewReader(`[
+		{"name": "greeting", "command": "echo", "args": ["hello"]},
+		{"command": "cat", "stdin": "hi\n", "env": ["FOO=bar"]}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Case{
+		{Name: "greeting", Command: "echo", Args: []string{"hello"}},
+		{Name: "1", Command: "cat", Stdin: "hi\n", Env: []string{"FOO=bar"}},
+	}
+	if !reflect.DeepEqual(cases, want) {
+		t.Errorf("ParseCases() = %#v, want %#v", cases, want)
+	}
+}
+
+func TestParseCasesErrors(t *testing.T) {
+	for _, tt := range []string{
+		`{"command": "echo"}`,
+		`[{"args": ["hello"]}]`,
+		`[{"command": "echo", "argv": ["hello"]}]`,
+	} {
+		if _, err := ParseCases(strings.NewReader(tt)); err == nil {
+			t.Errorf("ParseCases(%s) = nil, want error", tt)
+		}
+	}
+}
+
+func TestRunCompare(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbtest-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Stand-ins for a standalone command and a busybox that initializes
+	// differently.
+	standalone := filepath.Join(dir, "standalone")
+	if err := ioutil.WriteFile(standalone, []byte("#!/bin/sh\necho \"$FOO $1\"\ncat\necho oops >&2\nexit 3\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	busybox := filepath.Join(dir, "bb")
+	if err := ioutil.WriteFile(busybox, []byte("#!/bin/sh\necho \"$1\"\ncat\necho oops >&2\nexit 3\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	c := Case{Name: "env", Command: "foo", Args: []string{"arg"}, Stdin: "input\n", Env: []string{"FOO=bar"}}
+	workDir := filepath.Join(dir, "work")
+	s, err := run(context.Background(), standalone, workDir, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (&Result{ExitCode: 3, Stdout: "bar arg\ninput\n", Stderr: "oops\n"}); !reflect.DeepEqual(s, want) {
+		t.Errorf("run() = %#v, want %#v", s, want)
+	}
+
+	if m := compare(c, s, s); m != nil {
+		t.Errorf("compare(same results) = %v, want nil", m)
+	}
+
+	b, err := run(context.Background(), busybox, workDir, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := compare(c, s, b)
+	if m == nil {
+		t.Fatal("compare(different results) = nil, want mismatch")
+	}
+	want := "command foo, case \"env\" differs between standalone and busybox:\n  stdout: standalone \"bar arg\\ninput\\n\", busybox \"arg\\ninput\\n\""
+	if got := m.Error(); got != want {
+		t.Errorf("Mismatch.Error() = %q, want %q", got, want)
+	}
+}
+
+func TestVerifyAlias(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+	dir, err := ioutil.TempDir("", "bbtest-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		"go.mod": "module example.com/m\n\ngo 1.16\n",
+		"cmd/echo/echo.go": `package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+func main() {
+	fmt.Println(filepath.Base(os.Args[0]), os.Args[1:])
+}
+`,
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	env := golang.Default()
+	env.GO111MODULE = "on"
+	opts := &bb.Opts{
+		Env:          env,
+		CommandPaths: []string{filepath.Join(dir, "cmd/echo")},
+		Aliases:      map[string]string{"say": "echo"},
+	}
+	mismatches, err := Verify(context.Background(), opts, []Case{
+		{Name: "command", Command: "echo", Args: []string{"hi"}},
+		{Name: "alias", Command: "say", Args: []string{"hi"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range mismatches {
+		t.Error(m)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bbtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// Case is one invocation of a command.
+type Case struct {
+	// Name identifies the case in mismatches. It defaults to the case's
+	// index in the table.
+	Name string `json:"name"`
+
+	// Command is the name of the command to run, e.g. "ls", or an alias
+	// of the busybox for one. The command runs with Command as argv[0],
+	// both standalone and in the busybox.
+	Command string `json:"command"`
+
+	// Args are the command's arguments, not including argv[0].
+	Args []string `json:"args"`
+
+	// Stdin is written to the command's standard input.
+	Stdin string `json:"stdin"`
+
+	// Env are additional environment variables of the form "KEY=value".
+	Env []string `json:"env"`
+}
+
+// ReadCases reads a table of cases from the file at path.
+func ReadCases(path string) ([]Case, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cases, err := ParseCases(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return cases, nil
+}
+
+// ParseCases parses a table of cases.
+//
+// The table is a JSON array of cases:
+//
+//	[
+//	  {"name": "no args", "command": "echo"},
+//	  {"command": "cat", "args": ["-"], "stdin": "hello\n"},
+//	  {"command": "printenv", "args": ["FOO"], "env": ["FOO=bar"]}
+//	]
+func ParseCases(r io.Reader) ([]Case, error) {
+	d := json.NewDecoder(r)
+	d.DisallowUnknownFields()
+
+	var cases []Case
+	if err := d.Decode(&cases); err != nil {
+		return nil, err
+	}
+	for i := range cases {
+		if cases[i].Command == "" {
+			return nil, fmt.Errorf("case %d has no command", i)
+		}
+		if cases[i].Name == "" {
+			cases[i].Name = strconv.Itoa(i)
+		}
+	}
+	return cases, nil
+}
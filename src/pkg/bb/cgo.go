@@ -0,0 +1,110 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bb
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// usesCgo returns true if the files go/packages parsed for p are not the
+// user's source files, i.e. they are the output of cgo.
+func usesCgo(p *packages.Package) bool {
+	if len(p.GoFiles) != len(p.CompiledGoFiles) {
+		return true
+	}
+	for i := range p.GoFiles {
+		if p.GoFiles[i] != p.CompiledGoFiles[i] {
+			return true
+		}
+	}
+	return false
+}
+
+type importerFunc func(path string) (*types.Package, error)
+
+// Import implements types.Importer.Import.
+func (f importerFunc) Import(path string) (*types.Package, error) {
+	return f(path)
+}
+
+// depsImporter returns an importer for p's dependencies, which have
+// already been type-checked by go/packages.
+func depsImporter(p *packages.Package) types.Importer {
+	byPath := make(map[string]*types.Package)
+	if p.Types != nil {
+		for _, dep := range p.Types.Imports() {
+			byPath[dep.Path()] = dep
+		}
+	}
+	return importerFunc(func(path string) (*types.Package, error) {
+		if path == "unsafe" {
+			return types.Unsafe, nil
+		}
+		// p.Imports is keyed by the path as written in the source,
+		// which may differ from the package path for vendored
+		// packages.
+		if dep, ok := p.Imports[path]; ok {
+			if dep.Types != nil {
+				return dep.Types, nil
+			}
+			path = dep.PkgPath
+		}
+		if dep, ok := byPath[path]; ok {
+			return dep, nil
+		}
+		return nil, fmt.Errorf("package %q not found in dependencies of %s", path, p.PkgPath)
+	})
+}
+
+// parseGoFiles replaces p's syntax trees and type information with ones
+// derived from the user's GoFiles.
+//
+// For cgo packages, go/packages parses and type-checks the cgo-generated
+// CompiledGoFiles, which refer to cgo internals and are useless to rewrite.
+// The original files keep their `import "C"` preambles, and cgo is run on the
+// rewritten package again when the busybox is compiled.
+//
+// References to C are type-checked as if package C were empty, so global
+// variables initialized with C values must have an explicit type.
+func parseGoFiles(p *packages.Package) error {
+	fset := token.NewFileSet()
+	var files []*ast.File
+	for _, name := range p.GoFiles {
+		f, err := parser.ParseFile(fset, name, nil, parser.ParseComments)
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+
+	info := &types.Info{
+		Types: make(map[ast.Expr]types.TypeAndValue),
+		Defs:  make(map[*ast.Ident]types.Object),
+		Uses:  make(map[*ast.Ident]types.Object),
+
+		Selections: make(map[*ast.SelectorExpr]*types.Selection),
+	}
+	conf := types.Config{
+		Importer:    depsImporter(p),
+		FakeImportC: true,
+		// Keep going: we only need global declarations' types, and
+		// errors were already reported by go/packages.
+		Error: func(error) {},
+	}
+	tpkg, _ := conf.Check(p.PkgPath, fset, files, info)
+
+	p.Fset = fset
+	p.Syntax = files
+	p.CompiledGoFiles = p.GoFiles
+	p.Types = tpkg
+	p.TypesInfo = info
+	return nil
+}
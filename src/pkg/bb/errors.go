@@ -0,0 +1,170 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bb
+
+import (
+	"fmt"
+	"go/token"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// ModuleConflictError is returned when two definitions of the same module are
+// requested that cannot both be part of one busybox.
+type ModuleConflictError struct {
+	// ModulePath is the path of the module that is defined twice.
+	ModulePath string
+
+	// Provenance and OtherProvenance describe which definitions of the
+	// module are requested by whom, e.g. "github.com/u-root/u-bmc uses
+	// version v6.0.0".
+	Provenance      string
+	OtherProvenance string
+
+	// Replace is a replace directive that resolves the conflict when
+	// added to GoMod. Both are empty if there is no suggestion.
+	Replace string
+	GoMod   string
+}
+
+func (e *ModuleConflictError) Error() string {
+	s := fmt.Sprintf("conflicting module dependencies on %s: %s, but %s", e.ModulePath, e.Provenance, e.OtherProvenance)
+	if e.Replace != "" {
+		s += fmt.Sprintf(" (suggestion to resolve: add `%s` to %s)", e.Replace, e.GoMod)
+	}
+	return s
+}
+
+// ModuleConflictErrors is a list of all module conflicts found.
+type ModuleConflictErrors []*ModuleConflictError
+
+func (e ModuleConflictErrors) Error() string {
+	var s []string
+	for _, c := range e {
+		s = append(s, c.Error())
+	}
+	return strings.Join(s, "\n")
+}
+
+// DuplicateCommandError is returned when two commands have the same name.
+type DuplicateCommandError struct {
+	// Name is the command name.
+	Name string
+
+	// PkgPath and OtherPkgPath are the import paths of both commands.
+	PkgPath      string
+	OtherPkgPath string
+}
+
+func (e *DuplicateCommandError) Error() string {
+	return fmt.Sprintf("found duplicate command %s in %s and %s", e.Name, e.PkgPath, e.OtherPkgPath)
+}
+
+// RewriteError is returned when a command cannot be rewritten to be a
+// busybox-compatible package.
+type RewriteError struct {
+	// PkgPath is the import path of the command.
+	PkgPath string
+
+	// Pos is the position of the offending code, if there is one.
+	Pos token.Position
+
+	Err error
+}
+
+func (e *RewriteError) Error() string {
+	if e.Pos.IsValid() {
+		return fmt.Sprintf("rewriting command %s: %s: %v", e.PkgPath, e.Pos, e.Err)
+	}
+	return fmt.Sprintf("rewriting command %s: %v", e.PkgPath, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *RewriteError) Unwrap() error {
+	return e.Err
+}
+
+// LoadError is returned when a package has errors that prevent it from being
+// loaded.
+type LoadError struct {
+	// PkgPath is the import path of the package.
+	PkgPath string
+
+	// Errors are the errors reported by go/packages for the package and
+	// its dependencies.
+	Errors []PackageError
+}
+
+func (e *LoadError) Error() string {
+	s := fmt.Sprintf("package %s has errors:", e.PkgPath)
+	for _, err := range e.Errors {
+		if err.PkgPath == e.PkgPath {
+			s += "\n\t" + err.Err.Error()
+		} else {
+			s += "\n\t" + err.Error()
+		}
+	}
+	return s
+}
+
+// PackageError is an error reported by go/packages.
+type PackageError struct {
+	// PkgPath is the import path of the package that has the error,
+	// which may be a dependency of the package that failed to load.
+	PkgPath string
+
+	Err packages.Error
+}
+
+func (e PackageError) Error() string {
+	return fmt.Sprintf("in package %s: %v", e.PkgPath, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e PackageError) Unwrap() error {
+	return e.Err
+}
+
+// packageErrors returns the errors of p and its dependencies, or nil if there
+// are none.
+func packageErrors(p *packages.Package) *LoadError {
+	var errs []PackageError
+	packages.Visit([]*packages.Package{p}, nil, func(pkg *packages.Package) {
+		for _, err := range pkg.Errors {
+			errs = append(errs, PackageError{PkgPath: lookupPath(pkg), Err: err})
+		}
+	})
+	if len(errs) == 0 {
+		return nil
+	}
+	return &LoadError{PkgPath: lookupPath(p), Errors: errs}
+}
+
+// NotCommandError describes a loaded package that is not a command.
+type NotCommandError struct {
+	// ID is the go/packages ID of the package.
+	ID string
+
+	// Reason is why the package is not a command.
+	Reason string
+}
+
+func (e *NotCommandError) Error() string {
+	return fmt.Sprintf("package %s is not a command: %s", e.ID, e.Reason)
+}
+
+// SkippedPackagesError is returned when requested packages cannot be compiled
+// into the busybox. Each error is a *LoadError or a *NotCommandError, whose ID
+// is the requested path if it matches no packages.
+type SkippedPackagesError []error
+
+func (e SkippedPackagesError) Error() string {
+	s := fmt.Sprintf("%d requested package(s) cannot be compiled into the busybox:", len(e))
+	for _, err := range e {
+		s += "\n" + err.Error()
+	}
+	return s
+}
@@ -0,0 +1,347 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bb
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+// exitFile is the file written into commands rewritten with InterceptExit.
+const exitFile = "bbexit.go"
+
+// exitHelper is a function that replaces a function or method that exits.
+type exitHelper struct {
+	// name is the helper function's name in the rewritten command.
+	name string
+
+	// imports are the packages the helper's source uses.
+	imports []string
+
+	// src is the helper's source.
+	src string
+}
+
+// exitFuncs are the functions that exit, by package path and name, and the
+// helpers that replace references to them.
+var exitFuncs = map[[2]string]exitHelper{
+	{"os", "Exit"}: {
+		name: "BBExit",
+	},
+	{"log", "Fatal"}: {
+		name:    "bbFatal",
+		imports: []string{"fmt", "log"},
+		src: `func bbFatal(v ...interface{}) {
+	log.Output(2, fmt.Sprint(v...))
+	BBExit(1)
+}`,
+	},
+	{"log", "Fatalf"}: {
+		name:    "bbFatalf",
+		imports: []string{"fmt", "log"},
+		src: `func bbFatalf(format string, v ...interface{}) {
+	log.Output(2, fmt.Sprintf(format, v...))
+	BBExit(1)
+}`,
+	},
+	{"log", "Fatalln"}: {
+		name:    "bbFatalln",
+		imports: []string{"fmt", "log"},
+		src: `func bbFatalln(v ...interface{}) {
+	log.Output(2, fmt.Sprintln(v...))
+	BBExit(1)
+}`,
+	},
+	// The command line flag set exits on errors.
+	{"flag", "Parse"}: {
+		name:    "bbFlagParseCommandLine",
+		imports: []string{"flag", "os"},
+		src: `func bbFlagParseCommandLine() {
+	bbFlagParse(flag.CommandLine, os.Args[1:])
+}`,
+	},
+}
+
+// exitMethods are the methods that exit, by package path, receiver type name
+// and method name, and the helpers that replace calls to them. Helpers take
+// the receiver as their first argument.
+var exitMethods = map[[3]string]exitHelper{
+	{"log", "Logger", "Fatal"}: {
+		name:    "bbLoggerFatal",
+		imports: []string{"fmt", "log"},
+		src: `func bbLoggerFatal(l *log.Logger, v ...interface{}) {
+	l.Output(2, fmt.Sprint(v...))
+	BBExit(1)
+}`,
+	},
+	{"log", "Logger", "Fatalf"}: {
+		name:    "bbLoggerFatalf",
+		imports: []string{"fmt", "log"},
+		src: `func bbLoggerFatalf(l *log.Logger, format string, v ...interface{}) {
+	l.Output(2, fmt.Sprintf(format, v...))
+	BBExit(1)
+}`,
+	},
+	{"log", "Logger", "Fatalln"}: {
+		name:    "bbLoggerFatalln",
+		imports: []string{"fmt", "log"},
+		src: `func bbLoggerFatalln(l *log.Logger, v ...interface{}) {
+	l.Output(2, fmt.Sprintln(v...))
+	BBExit(1)
+}`,
+	},
+	// Flag sets created with flag.ExitOnError exit on errors.
+	{"flag", "FlagSet", "Parse"}: {
+		name:    "bbFlagParse",
+		imports: []string{"flag"},
+		src: `func bbFlagParse(f *flag.FlagSet, arguments []string) error {
+	if f.ErrorHandling() != flag.ExitOnError {
+		return f.Parse(arguments)
+	}
+	f.Init(f.Name(), flag.ContinueOnError)
+	defer f.Init(f.Name(), flag.ExitOnError)
+	if err := f.Parse(arguments); err == flag.ErrHelp {
+		BBExit(0)
+	} else if err != nil {
+		BBExit(2)
+	}
+	return nil
+}`,
+	},
+}
+
+// exitHelperDeps are helpers that helpers call.
+var exitHelperDeps = map[string]exitHelper{
+	"bbFlagParseCommandLine": exitMethods[[3]string{"flag", "FlagSet", "Parse"}],
+}
+
+// exitFunc returns the helper replacing obj, if obj is a function that exits.
+func exitFunc(obj types.Object) (exitHelper, bool) {
+	fn, ok := obj.(*types.Func)
+	if !ok || fn.Pkg() == nil || fn.Type().(*types.Signature).Recv() != nil {
+		return exitHelper{}, false
+	}
+	h, ok := exitFuncs[[2]string{fn.Pkg().Path(), fn.Name()}]
+	return h, ok
+}
+
+// exitMethod returns the helper replacing calls to obj, if obj is a method
+// that exits.
+func exitMethod(obj types.Object) (exitHelper, bool) {
+	fn, ok := obj.(*types.Func)
+	if !ok || fn.Pkg() == nil {
+		return exitHelper{}, false
+	}
+	recv := fn.Type().(*types.Signature).Recv()
+	if recv == nil {
+		return exitHelper{}, false
+	}
+	typ := recv.Type()
+	if ptr, ok := typ.(*types.Pointer); ok {
+		typ = ptr.Elem()
+	}
+	named, ok := typ.(*types.Named)
+	if !ok {
+		return exitHelper{}, false
+	}
+	h, ok := exitMethods[[3]string{fn.Pkg().Path(), named.Obj().Name(), fn.Name()}]
+	return h, ok
+}
+
+// interceptExit replaces references to functions that exit, and calls of
+// methods that exit, in f with calls of helpers that exit through BBExit.
+//
+// Functions and methods are identified by what their identifiers refer to,
+// so renamed imports and dot imports are handled. Method values, e.g.
+// `fatal := logger.Fatal`, and methods promoted through embedding are left
+// alone.
+//
+// The helpers used are added to used.
+func (p *Package) interceptExit(f *ast.File, used map[string]exitHelper) {
+	info := p.Pkg.TypesInfo
+	astutil.Apply(f, nil, func(c *astutil.Cursor) bool {
+		switch n := c.Node().(type) {
+		case *ast.Ident:
+			// Dot imports. Selectors are replaced as a whole.
+			if sel, ok := c.Parent().(*ast.SelectorExpr); ok && sel.Sel == n {
+				break
+			}
+			if h, ok := exitFunc(info.Uses[n]); ok {
+				used[h.name] = h
+				c.Replace(ast.NewIdent(h.name))
+			}
+
+		case *ast.SelectorExpr:
+			if h, ok := exitFunc(info.Uses[n.Sel]); ok {
+				used[h.name] = h
+				c.Replace(ast.NewIdent(h.name))
+			}
+
+		case *ast.CallExpr:
+			sel, ok := n.Fun.(*ast.SelectorExpr)
+			if !ok {
+				break
+			}
+			h, ok := exitMethod(info.Uses[sel.Sel])
+			if !ok {
+				break
+			}
+			if s, ok := info.Selections[sel]; ok && len(s.Index()) > 1 {
+				break
+			}
+			recv := sel.X
+			if _, ok := info.TypeOf(recv).(*types.Pointer); !ok {
+				recv = &ast.UnaryExpr{Op: token.AND, X: recv}
+			}
+			used[h.name] = h
+			c.Replace(&ast.CallExpr{
+				Fun:      ast.NewIdent(h.name),
+				Args:     append([]ast.Expr{recv}, n.Args...),
+				Ellipsis: n.Ellipsis,
+			})
+		}
+		return true
+	})
+
+	// Imports of packages that were only used to exit are now unused.
+	for _, path := range []string{"flag", "log", "os"} {
+		p.deleteUnusedImport(f, path)
+	}
+}
+
+// deleteUnusedImport deletes the import of path from f if f does not refer
+// to it anymore. path must be a standard library package whose name is its
+// path.
+func (p *Package) deleteUnusedImport(f *ast.File, path string) {
+	var spec *ast.ImportSpec
+	for _, impt := range f.Imports {
+		if importPath, err := strconv.Unquote(impt.Path.Value); err == nil && importPath == path {
+			spec = impt
+		}
+	}
+	// Blank imports are used for their side effects.
+	if spec == nil || (spec.Name != nil && spec.Name.Name == "_") {
+		return
+	}
+	name, localName := "", path
+	if spec.Name != nil {
+		name, localName = spec.Name.Name, spec.Name.Name
+	}
+	var imported *types.Package
+	for _, pkg := range p.Pkg.Types.Imports() {
+		if pkg.Path() == path {
+			imported = pkg
+		}
+	}
+
+	used := false
+	ast.Inspect(f, func(n ast.Node) bool {
+		id, ok := n.(*ast.Ident)
+		if !ok || used {
+			return !used
+		}
+		obj, checked := p.Pkg.TypesInfo.Uses[id]
+		switch {
+		case checked && localName == ".":
+			used = obj.Pkg() != nil && obj.Pkg().Path() == path && obj.Parent() == obj.Pkg().Scope()
+
+		case checked:
+			pn, ok := obj.(*types.PkgName)
+			used = ok && pn.Imported().Path() == path
+
+		// Identifiers added by the rewrite, e.g. of spelled out
+		// types, were not type-checked.
+		case p.Pkg.TypesInfo.Defs[id] != nil:
+		case localName == ".":
+			used = imported == nil || imported.Scope().Lookup(id.Name) != nil
+		default:
+			used = id.Name == localName
+		}
+		return !used
+	})
+	if !used {
+		astutil.DeleteNamedImport(p.Pkg.Fset, f, name, path)
+	}
+}
+
+// checkExitNames returns an error if names that InterceptExit adds to the
+// command are already declared in it.
+func (p *Package) checkExitNames() error {
+	if p.Pkg.Types == nil {
+		return nil
+	}
+	names := []string{"BBExit"}
+	for _, h := range exitFuncs {
+		names = append(names, h.name)
+	}
+	for _, h := range exitMethods {
+		names = append(names, h.name)
+	}
+	for _, name := range names {
+		if obj := p.Pkg.Types.Scope().Lookup(name); obj != nil {
+			return &RewriteError{
+				PkgPath: p.Pkg.PkgPath,
+				Pos:     p.Pkg.Fset.Position(obj.Pos()),
+				Err:     fmt.Errorf("%s is reserved for intercepting exits", name),
+			}
+		}
+	}
+	for _, name := range p.Pkg.GoFiles {
+		if filepath.Base(name) == exitFile {
+			return &RewriteError{
+				PkgPath: p.Pkg.PkgPath,
+				Err:     fmt.Errorf("file name %s is reserved for intercepting exits", exitFile),
+			}
+		}
+	}
+	return nil
+}
+
+// writeExitFile writes the source of BBExit and the used helpers into
+// destDir.
+func (p *Package) writeExitFile(destDir string, used map[string]exitHelper) error {
+	for name := range used {
+		if dep, ok := exitHelperDeps[name]; ok {
+			used[dep.name] = dep
+		}
+	}
+
+	imports := map[string]struct{}{"os": {}}
+	var names []string
+	for name, h := range used {
+		for _, impt := range h.imports {
+			imports[impt] = struct{}{}
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var importPaths []string
+	for impt := range imports {
+		importPaths = append(importPaths, impt)
+	}
+	sort.Strings(importPaths)
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "package %s\n\nimport (\n", p.Name)
+	for _, impt := range importPaths {
+		fmt.Fprintf(&b, "\t%q\n", impt)
+	}
+	fmt.Fprintf(&b, ")\n\n")
+	fmt.Fprintf(&b, "// BBExit is called instead of os.Exit. The busybox sets it to its exit\n// hook.\nvar BBExit = os.Exit\n")
+	for _, name := range names {
+		if used[name].src != "" {
+			fmt.Fprintf(&b, "\n%s\n", used[name].src)
+		}
+	}
+	return writeGoFile(filepath.Join(destDir, exitFile), b.Bytes())
+}
@@ -0,0 +1,206 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bb
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// exitCommands are commands that exit in different ways, and print "deferred"
+// if their deferred functions run.
+var exitCommands = map[string]string{
+	"osexit": `package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func main() {
+	defer fmt.Println("deferred")
+	os.Exit(3)
+}
+`,
+	"renamed": `package main
+
+import (
+	"fmt"
+	xos "os"
+)
+
+func main() {
+	defer fmt.Println("deferred")
+	exit := xos.Exit
+	exit(4)
+}
+`,
+	"dotimport": `package main
+
+import (
+	"fmt"
+	. "os"
+)
+
+func main() {
+	defer fmt.Println("deferred")
+	Exit(5)
+}
+`,
+	"fatal": `package main
+
+import (
+	"fmt"
+	"log"
+)
+
+func init() {
+	log.SetFlags(0)
+}
+
+func main() {
+	defer fmt.Println("deferred")
+	log.Fatalf("fatal %d", 1)
+}
+`,
+	"logger": `package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+)
+
+var l = log.New(os.Stdout, "logger: ", 0)
+
+func main() {
+	defer fmt.Println("deferred")
+	args := []interface{}{"a", "b"}
+	l.Fatalln(args...)
+}
+`,
+	"flags": `package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+var v = flag.Bool("v", false, "verbose")
+
+func main() {
+	defer fmt.Println("deferred")
+	flag.CommandLine.SetOutput(os.Stdout)
+	flag.Usage = func() { fmt.Println("usage") }
+	flag.Parse()
+	fmt.Println("v", *v)
+}
+`,
+	"flagset": `package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+func main() {
+	defer fmt.Println("deferred")
+	var fs flag.FlagSet
+	fs.Init("flagset", flag.ExitOnError)
+	fs.SetOutput(os.Stdout)
+	fs.Bool("v", false, "verbose")
+	if err := fs.Parse(os.Args[1:]); err != nil {
+		panic(err)
+	}
+	fmt.Println("args", fs.Args())
+}
+`,
+}
+
+// exitHook is a busybox main file that registers an exit hook that prints
+// the exit code.
+const exitHook = `package main
+
+import "fmt"
+
+func init() {
+	AddExitHook(func(code int) { fmt.Println("hook", code) })
+}
+`
+
+// TestInterceptExit checks that exits of commands rewritten with
+// InterceptExit run the busybox's exit hooks, and their deferred functions
+// if exits panic.
+func TestInterceptExit(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+
+	for _, exitPanics := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "test-interceptexit-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		opts := &MainOpts{InterceptExit: true, ExitPanics: exitPanics}
+		bin := buildTestBusybox(t, dir, exitCommands, opts, map[string]string{"hook.go": exitHook})
+
+		deferred := ""
+		if exitPanics {
+			deferred = "deferred\n"
+		}
+		for _, tt := range []struct {
+			args     []string
+			wantCode int
+			want     string
+		}{
+			{args: []string{"osexit"}, wantCode: 3, want: deferred + "hook 3\n"},
+			{args: []string{"renamed"}, wantCode: 4, want: deferred + "hook 4\n"},
+			{args: []string{"dotimport"}, wantCode: 5, want: deferred + "hook 5\n"},
+			{args: []string{"fatal"}, wantCode: 1, want: "fatal 1\n" + deferred + "hook 1\n"},
+			{args: []string{"logger"}, wantCode: 1, want: "logger: a b\n" + deferred + "hook 1\n"},
+			// Commands that do not exit still run the hooks.
+			{args: []string{"flags", "-v"}, wantCode: 0, want: "v true\ndeferred\nhook 0\n"},
+			{args: []string{"flags", "-x"}, wantCode: 2, want: "flag provided but not defined: -x\nusage\n" + deferred + "hook 2\n"},
+			{args: []string{"flagset", "-h"}, wantCode: 0, want: "Usage of flagset:\n  -v\tverbose\n" + deferred + "hook 0\n"},
+			{args: []string{"flagset", "a"}, wantCode: 0, want: "args [a]\ndeferred\nhook 0\n"},
+		} {
+			code, out := runTestBusybox(t, bin, nil, tt.args...)
+			if code != tt.wantCode || out != tt.want {
+				t.Errorf("ExitPanics=%t: bb %v = (%d, %q), want (%d, %q)", exitPanics, tt.args, code, out, tt.wantCode, tt.want)
+			}
+		}
+	}
+}
+
+func TestInterceptExitReservedName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-interceptexit-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTestFiles(t, dir, map[string]string{"main.go": `package main
+
+func bbFatal() {}
+
+func main() { bbFatal() }
+`})
+	p := loadTestPackage(t, "example.com/cmd/reserved", dir, "main.go")
+	cmd := NewPackage("reserved", p)
+	cmd.InterceptExit = true
+	err = cmd.Rewrite(filepath.Join(dir, "out"))
+	var rerr *RewriteError
+	if !errors.As(err, &rerr) || !strings.Contains(err.Error(), "bbFatal is reserved") {
+		t.Errorf("Rewrite = %v, want RewriteError about bbFatal", err)
+	}
+}
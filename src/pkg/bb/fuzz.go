@@ -0,0 +1,294 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build gofuzz
+// +build gofuzz
+
+package bb
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// Fuzz is a go-fuzz harness for Package.Rewrite.
+//
+// data drives the generation of a command with globals that depend on each
+// other through expressions, functions and closures, spread across files with
+// init functions. The command is rewritten and the result is type-checked,
+// and the rewritten Init must initialize variables in the original
+// InitOrder and then call the init functions in their original order.
+//
+//	go-fuzz-build github.com/u-root/gobusybox/src/pkg/bb
+//	go-fuzz -bin bb-fuzz.zip -workdir fuzz
+func Fuzz(data []byte) int {
+	files := genCommand(&fuzzSource{data: data})
+
+	dir, err := ioutil.TempDir("", "bb-fuzz-")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p, err := checkFuzzPackage("example.com/cmd/fuzz", files)
+	if err != nil {
+		panic(fmt.Sprintf("generated command does not type-check: %v\n%s", err, dumpFiles(files)))
+	}
+	wantVars := initOrder(p.TypesInfo)
+	wantInits := initFuncs(p.Syntax)
+
+	if err := NewPackage("fuzz", p).Rewrite(dir); err != nil {
+		panic(fmt.Sprintf("Rewrite: %v\n%s", err, dumpFiles(files)))
+	}
+
+	rewritten := make(map[string]string)
+	for name := range files {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			panic(err)
+		}
+		rewritten[name] = string(b)
+	}
+	rp, err := checkFuzzPackage("example.com/cmd/fuzz", rewritten)
+	if err != nil {
+		panic(fmt.Sprintf("rewritten command does not type-check: %v\n%s", err, dumpFiles(rewritten)))
+	}
+	if order := initOrder(rp.TypesInfo); len(order) > 0 {
+		panic(fmt.Sprintf("rewritten command still initializes %v at package level\n%s", order, dumpFiles(rewritten)))
+	}
+
+	gotVars, gotInits := rewrittenInit(rp.Syntax)
+	if !equalStrings(gotVars, wantVars) {
+		panic(fmt.Sprintf("rewritten Init initializes %v, want %v\n%s", gotVars, wantVars, dumpFiles(rewritten)))
+	}
+	if !equalStrings(gotInits, wantInits) {
+		panic(fmt.Sprintf("rewritten Init calls init functions %v, want %v\n%s", gotInits, wantInits, dumpFiles(rewritten)))
+	}
+	return 1
+}
+
+// fuzzSource hands out fuzzer input as small integers, and zeroes once the
+// input is exhausted.
+type fuzzSource struct {
+	data []byte
+}
+
+// next returns an integer in [0, n).
+func (s *fuzzSource) next(n int) int {
+	if len(s.data) == 0 {
+		return 0
+	}
+	b := s.data[0]
+	s.data = s.data[1:]
+	return int(b) % n
+}
+
+// genCommand generates the files of a valid Go command.
+func genCommand(s *fuzzSource) map[string]string {
+	nFiles := 1 + s.next(3)
+	nVars := 1 + s.next(8)
+	bodies := make([]strings.Builder, nFiles)
+
+	// Variables may only refer to variables of lower rank, which keeps
+	// initialization free of cycles but not in declaration order.
+	rank := make([]int, nVars)
+	for i := range rank {
+		rank[i] = i
+	}
+	for i := len(rank) - 1; i > 0; i-- {
+		j := s.next(i + 1)
+		rank[i], rank[j] = rank[j], rank[i]
+	}
+	expr := func(i int) string {
+		terms := []string{fmt.Sprint(s.next(10))}
+		for n := s.next(3); n > 0; n-- {
+			if j := s.next(nVars); rank[j] < rank[i] {
+				terms = append(terms, fmt.Sprintf("v%d", j))
+			}
+		}
+		return strings.Join(terms, " + ")
+	}
+
+	for i := 0; i < nVars; i++ {
+		b := &bodies[s.next(nFiles)]
+		switch s.next(6) {
+		case 0:
+			fmt.Fprintf(b, "var v%d = %s\n\n", i, expr(i))
+		case 1:
+			fmt.Fprintf(b, "var v%d int = %s\n\n", i, expr(i))
+		case 2:
+			fmt.Fprintf(b, "func f%d() int { return %s }\n\nvar v%d = f%d()\n\n", i, expr(i), i, i)
+		case 3:
+			fmt.Fprintf(b, "var v%d = func() int { return %s }()\n\n", i, expr(i))
+		case 4:
+			fmt.Fprintf(b, "func pair%d() (int, string) { return %s, \"w%d\" }\n\nvar v%d, w%d = pair%d()\n\n", i, expr(i), i, i, i, i)
+		case 5:
+			fmt.Fprintf(b, "var (\n\tv%d, w%d = %s, \"w%d\"\n)\n\n", i, i, expr(i), i)
+		}
+	}
+
+	fmt.Fprintf(&bodies[0], "var trace []string\n\n")
+	for i, n := 0, s.next(4); i < n; i++ {
+		fmt.Fprintf(&bodies[s.next(nFiles)], "func init() { trace = append(trace, \"init%d\") }\n\n", i)
+	}
+	fmt.Fprintf(&bodies[s.next(nFiles)], "func main() { println(len(trace)) }\n")
+
+	files := make(map[string]string)
+	for i := range bodies {
+		files[fmt.Sprintf("file%d.go", i)] = "package main\n\n" + bodies[i].String()
+	}
+	return files
+}
+
+// checkFuzzPackage parses and type-checks files in file name order.
+func checkFuzzPackage(pkgPath string, files map[string]string) (*packages.Package, error) {
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	p := &packages.Package{
+		Name:    "main",
+		PkgPath: pkgPath,
+		Fset:    token.NewFileSet(),
+		TypesInfo: &types.Info{
+			Types: make(map[ast.Expr]types.TypeAndValue),
+			Defs:  make(map[*ast.Ident]types.Object),
+			Uses:  make(map[*ast.Ident]types.Object),
+		},
+	}
+	for _, name := range names {
+		f, err := parser.ParseFile(p.Fset, name, files[name], parser.ParseComments)
+		if err != nil {
+			return nil, err
+		}
+		p.GoFiles = append(p.GoFiles, name)
+		p.CompiledGoFiles = append(p.CompiledGoFiles, name)
+		p.Syntax = append(p.Syntax, f)
+	}
+
+	var conf types.Config
+	tpkg, err := conf.Check(pkgPath, p.Fset, p.Syntax, p.TypesInfo)
+	if err != nil {
+		return nil, err
+	}
+	p.Types = tpkg
+	return p, nil
+}
+
+// initOrder returns the variables of each package-level initializer in
+// order, e.g. "v2" or "v1,w1".
+func initOrder(info *types.Info) []string {
+	var order []string
+	for _, init := range info.InitOrder {
+		var names []string
+		for _, v := range init.Lhs {
+			names = append(names, v.Name())
+		}
+		order = append(order, strings.Join(names, ","))
+	}
+	return order
+}
+
+// initFuncs returns the trace strings of a generated command's init
+// functions in the order the spec runs them.
+func initFuncs(files []*ast.File) []string {
+	var inits []string
+	for _, f := range files {
+		for _, decl := range f.Decls {
+			if fn, ok := decl.(*ast.FuncDecl); ok && fn.Name.Name == "init" {
+				inits = append(inits, traceString(fn))
+			}
+		}
+	}
+	return inits
+}
+
+// traceString returns the string a generated init function appends to
+// trace.
+func traceString(fn *ast.FuncDecl) string {
+	var s string
+	ast.Inspect(fn.Body, func(n ast.Node) bool {
+		if lit, ok := n.(*ast.BasicLit); ok && lit.Kind == token.STRING {
+			s = strings.Trim(lit.Value, `"`)
+		}
+		return true
+	})
+	return s
+}
+
+// rewrittenInit returns the variables assigned by the rewritten Init, in the
+// format of initOrder, and the trace strings of the init functions it calls.
+func rewrittenInit(files []*ast.File) ([]string, []string) {
+	funcs := make(map[string]*ast.FuncDecl)
+	for _, f := range files {
+		for _, decl := range f.Decls {
+			if fn, ok := decl.(*ast.FuncDecl); ok {
+				funcs[fn.Name.Name] = fn
+			}
+		}
+	}
+	calls := func(fn *ast.FuncDecl) []*ast.FuncDecl {
+		var callees []*ast.FuncDecl
+		for _, stmt := range fn.Body.List {
+			call := stmt.(*ast.ExprStmt).X.(*ast.CallExpr)
+			callees = append(callees, funcs[call.Fun.(*ast.Ident).Name])
+		}
+		return callees
+	}
+
+	// Init calls the variable initializer Init0 first, followed by the
+	// init functions.
+	initCalls := calls(funcs["Init"])
+	var vars []string
+	for _, fn := range calls(initCalls[0]) {
+		var names []string
+		for _, lhs := range fn.Body.List[0].(*ast.AssignStmt).Lhs {
+			names = append(names, lhs.(*ast.Ident).Name)
+		}
+		vars = append(vars, strings.Join(names, ","))
+	}
+	var inits []string
+	for _, fn := range initCalls[1:] {
+		inits = append(inits, traceString(fn))
+	}
+	return vars, inits
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func dumpFiles(files map[string]string) string {
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "// %s\n%s\n", name, files[name])
+	}
+	return b.String()
+}
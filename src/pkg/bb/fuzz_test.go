@@ -0,0 +1,25 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build gofuzz
+// +build gofuzz
+
+package bb
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// TestFuzz runs the Fuzz harness on random inputs:
+//
+//	go test -tags gofuzz -run TestFuzz ./pkg/bb
+func TestFuzz(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		data := make([]byte, r.Intn(64))
+		r.Read(data)
+		Fuzz(data)
+	}
+}
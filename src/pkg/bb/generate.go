@@ -1,3 +1,3 @@
-//go:generate embedvar -file=./bbmain/cmd/main.go -varname=bbMainSource -p=bb -o=bbmain_src.go
+//go:generate embedvar -type=map -root=./bbmain/cmd -file=./bbmain/cmd/main.go -varname=bbMainTemplate -p=bb -o=bbmain_src.go
 
 package bb
@@ -0,0 +1,134 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bb
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Manifest is a list of commands to compile into a busybox.
+//
+// A manifest file has one command per line, given either as a Go import path
+// or as a file system path starting with "." or "/". Relative file system
+// paths are relative to the manifest's directory, and may contain
+// filepath.Match patterns. Empty lines and lines starting with # are ignored.
+//
+// Commands are required unless the line starts with "optional", in which case
+// packages that fail to load or are not commands are skipped with a warning.
+// A line "default NAME" names the command that the busybox runs if neither
+// argv[0] nor argv[1] name a command:
+//
+//	# Core commands must always be there.
+//	./u-root/cmds/core/*
+//	github.com/u-root/u-bmc/cmd/fan
+//
+//	# Experimental commands are best-effort.
+//	optional ./u-root/cmds/exp/*
+//
+//	# Start init when run as PID 1.
+//	default init
+type Manifest struct {
+	// Commands are the paths of required commands.
+	Commands []string
+
+	// Optional are the paths of best-effort commands.
+	Optional []string
+
+	// Default is the name of the default command, if any.
+	Default string
+}
+
+// ReadManifest reads the manifest file at path.
+func ReadManifest(path string) (*Manifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	m, err := ParseManifest(f, filepath.Dir(path))
+	if err != nil {
+		return nil, fmt.Errorf("manifest %s: %v", path, err)
+	}
+	return m, nil
+}
+
+// ParseManifest parses a manifest. Relative file system paths are interpreted
+// relative to dir.
+func ParseManifest(r io.Reader, dir string) (*Manifest, error) {
+	// Relative paths would be mistaken for Go import paths.
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manifest{}
+	s := bufio.NewScanner(r)
+	for lineno := 1; s.Scan(); lineno++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		if fields[0] == "default" {
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("line %d: want one default command name, got %q", lineno, s.Text())
+			}
+			if m.Default != "" {
+				return nil, fmt.Errorf("line %d: default command already set to %q", lineno, m.Default)
+			}
+			m.Default = fields[1]
+			continue
+		}
+
+		optional := fields[0] == "optional"
+		if optional {
+			fields = fields[1:]
+		}
+		if len(fields) != 1 {
+			return nil, fmt.Errorf("line %d: want one command path, got %q", lineno, s.Text())
+		}
+
+		paths, err := expandPath(fields[0], dir)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineno, err)
+		}
+		if optional {
+			m.Optional = append(m.Optional, paths...)
+		} else {
+			m.Commands = append(m.Commands, paths...)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// expandPath resolves a manifest command path relative to dir, and expands
+// file system patterns.
+func expandPath(p, dir string) ([]string, error) {
+	if !strings.HasPrefix(p, ".") && !strings.HasPrefix(p, "/") {
+		// Go import path.
+		return []string{p}, nil
+	}
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(dir, p)
+	}
+	matches, err := filepath.Glob(p)
+	if err != nil {
+		return nil, err
+	}
+	// Let loading the package report paths that don't exist.
+	if len(matches) == 0 {
+		return []string{p}, nil
+	}
+	return matches, nil
+}
@@ -0,0 +1,73 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-manifest-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, d := range []string{"cmds/core/cat", "cmds/core/ls", "cmds/exp/fan"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m, err := ParseManifest(strings.NewReader(`
+# Core commands.
+./cmds/core/*
+github.com/u-root/u-bmc/cmd/login
+
+  optional ./cmds/exp/*
+optional github.com/u-root/u-root/cmds/exp/...
+
+default ls
+`), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &Manifest{
+		Commands: []string{
+			filepath.Join(dir, "cmds/core/cat"),
+			filepath.Join(dir, "cmds/core/ls"),
+			"github.com/u-root/u-bmc/cmd/login",
+		},
+		Optional: []string{
+			filepath.Join(dir, "cmds/exp/fan"),
+			"github.com/u-root/u-root/cmds/exp/...",
+		},
+		Default: "ls",
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("ParseManifest() = %#v, want %#v", m, want)
+	}
+}
+
+func TestParseManifestErrors(t *testing.T) {
+	for _, tt := range []string{
+		"optional\n",
+		"./cmds/ls ./cmds/cat\n",
+		"./cmds/[\n",
+		"default\n",
+		"default ls cat\n",
+		"default ls\ndefault cat\n",
+	} {
+		if _, err := ParseManifest(strings.NewReader(tt), "/"); err == nil {
+			t.Errorf("ParseManifest(%q) = nil, want error", tt)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bb
+
+import (
+	"context"
+	"runtime"
+	"sync"
+)
+
+// parallel calls f(i) for every i in [0, n), running up to jobs calls
+// concurrently. If jobs is less than 1, runtime.NumCPU() is used.
+//
+// Once ctx is done, no more calls are started and the i that were not
+// started fail with ctx.Err(). Calls that were started run to completion
+// before parallel returns. The error returned is the one of the lowest i
+// that failed, so that results do not depend on scheduling.
+func parallel(ctx context.Context, jobs, n int, f func(i int) error) error {
+	if jobs < 1 {
+		jobs = runtime.NumCPU()
+	}
+
+	errs := make([]error, n)
+	sem := make(chan struct{}, jobs)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		select {
+		case <-ctx.Done():
+		case sem <- struct{}{}:
+		}
+		// A free slot and a done ctx may be ready at the same time.
+		if err := ctx.Err(); err != nil {
+			for ; i < n; i++ {
+				errs[i] = err
+			}
+			break
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			errs[i] = f(i)
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParallel(t *testing.T) {
+	const jobs = 3
+	var (
+		mu      sync.Mutex
+		running int
+		max     int
+		called  = make([]bool, 20)
+	)
+	err := parallel(context.Background(), jobs, len(called), func(i int) error {
+		mu.Lock()
+		running++
+		if running > max {
+			max = running
+		}
+		called[i] = true
+		mu.Unlock()
+
+		time.Sleep(time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+
+		if i == 7 || i == 13 {
+			return fmt.Errorf("job %d failed", i)
+		}
+		return nil
+	})
+
+	if err == nil || err.Error() != "job 7 failed" {
+		t.Errorf("parallel() = %v, want job 7 failed", err)
+	}
+	if max > jobs {
+		t.Errorf("parallel() ran %d jobs concurrently, want at most %d", max, jobs)
+	}
+	for i, ok := range called {
+		if !ok {
+			t.Errorf("parallel() did not call f(%d)", i)
+		}
+	}
+}
+
+func TestParallelCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		mu     sync.Mutex
+		called = make([]bool, 20)
+	)
+	err := parallel(ctx, 1, len(called), func(i int) error {
+		mu.Lock()
+		called[i] = true
+		mu.Unlock()
+		if i == 4 {
+			cancel()
+		}
+		return nil
+	})
+
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("parallel() = %v, want %v", err, context.Canceled)
+	}
+	for i, ok := range called {
+		if want := i <= 4; ok != want {
+			t.Errorf("parallel() called f(%d) = %t, want %t", i, ok, want)
+		}
+	}
+}
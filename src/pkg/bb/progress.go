@@ -0,0 +1,184 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bb
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// Level is the severity of a log message.
+type Level int
+
+// Log levels, in increasing order of severity.
+const (
+	// LevelDebug messages are diagnostics, e.g. phase timings.
+	LevelDebug Level = iota
+
+	// LevelInfo messages are of general interest.
+	LevelInfo
+
+	// LevelWarning messages report something the user should likely fix,
+	// e.g. skipped packages.
+	LevelWarning
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarning:
+		return "warning"
+	}
+	return "unknown"
+}
+
+// Logger is the logging interface used by BuildBusybox.
+type Logger interface {
+	Logf(level Level, format string, v ...interface{})
+}
+
+type discardLogger struct{}
+
+func (discardLogger) Logf(Level, string, ...interface{}) {}
+
+type stdLogger struct {
+	l   *log.Logger
+	min Level
+}
+
+// Logf implements Logger.Logf.
+func (s stdLogger) Logf(level Level, format string, v ...interface{}) {
+	if level >= s.min {
+		s.l.Printf(format, v...)
+	}
+}
+
+// NewLogger returns a Logger that prints messages of level min or above to l.
+func NewLogger(l *log.Logger, min Level) Logger {
+	return stdLogger{l: l, min: min}
+}
+
+// Phase is a phase of BuildBusybox.
+type Phase int
+
+// Phases of BuildBusybox, in the order they run.
+const (
+	// PhaseLoad loads command packages and their dependencies.
+	PhaseLoad Phase = iota
+
+	// PhaseRewrite rewrites commands into bb packages.
+	PhaseRewrite
+
+	// PhaseDeps writes dependencies and go.mod files.
+	PhaseDeps
+
+	// PhaseMain generates the busybox main package.
+	PhaseMain
+
+	// PhaseCompile compiles the busybox.
+	PhaseCompile
+)
+
+func (p Phase) String() string {
+	switch p {
+	case PhaseLoad:
+		return "load"
+	case PhaseRewrite:
+		return "rewrite"
+	case PhaseDeps:
+		return "deps"
+	case PhaseMain:
+		return "main generation"
+	case PhaseCompile:
+		return "compile"
+	}
+	return "unknown"
+}
+
+// Event reports progress of BuildBusybox.
+//
+// Each phase is reported when it starts and when it is done. In between, the
+// load and rewrite phases report an event for each command as soon as it is
+// done with it.
+type Event struct {
+	Phase Phase
+
+	// Command is the import path of the command this event is about, or
+	// empty if the event is about the whole phase.
+	Command string
+
+	// Done is false when the phase starts, and true when the phase or
+	// command is done.
+	Done bool
+
+	// Duration is how long the phase or command took, if Done. Commands
+	// are loaded in one batch per module, so a loaded command's Duration
+	// is that of its batch.
+	Duration time.Duration
+}
+
+// reporter sends log messages and progress events of one build.
+type reporter struct {
+	l Logger
+
+	// mu serializes calls to progress, which may come from concurrent
+	// rewrites.
+	mu       sync.Mutex
+	progress func(Event)
+}
+
+func newReporter(opts *Opts) *reporter {
+	r := &reporter{
+		l:        opts.Logger,
+		progress: opts.Progress,
+	}
+	if r.l == nil {
+		r.l = discardLogger{}
+	}
+	return r
+}
+
+func (r *reporter) event(e Event) {
+	if r.progress == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.progress(e)
+}
+
+// phase reports the start of phase p and returns a func that reports its
+// end.
+func (r *reporter) phase(p Phase) func() {
+	start := time.Now()
+	r.event(Event{Phase: p})
+	return func() {
+		d := time.Since(start)
+		r.l.Logf(LevelDebug, "Phase %s took %v", p, d)
+		r.event(Event{Phase: p, Done: true, Duration: d})
+	}
+}
+
+// command reports that phase p is done with command pkgPath, which took
+// since start.
+func (r *reporter) command(p Phase, pkgPath string, start time.Time) {
+	r.event(Event{Phase: p, Command: pkgPath, Done: true, Duration: time.Since(start)})
+}
+
+// loaded reports that the commands among pkgs, whose loading began at start,
+// are loaded.
+func (r *reporter) loaded(pkgs []*packages.Package, start time.Time) {
+	for _, p := range pkgs {
+		if notCommand(p) == nil {
+			r.command(PhaseLoad, p.PkgPath, start)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bb
+
+import (
+	"bytes"
+	"log"
+	"testing"
+	"time"
+
+	"golang.org/x/tools/go/packages"
+)
+
+func TestNewLogger(t *testing.T) {
+	var b bytes.Buffer
+	l := NewLogger(log.New(&b, "", 0), LevelInfo)
+
+	l.Logf(LevelDebug, "debug %d", 1)
+	l.Logf(LevelInfo, "info %d", 2)
+	l.Logf(LevelWarning, "warning %d", 3)
+
+	if got, want := b.String(), "info 2\nwarning 3\n"; got != want {
+		t.Errorf("log output = %q, want %q", got, want)
+	}
+}
+
+func TestReporter(t *testing.T) {
+	var events []Event
+	r := newReporter(&Opts{
+		Progress: func(e Event) {
+			// Durations are not deterministic.
+			e.Duration = 0
+			events = append(events, e)
+		},
+	})
+
+	done := r.phase(PhaseLoad)
+	r.loaded([]*packages.Package{
+		{ID: "example.com/cmd/ls", PkgPath: "example.com/cmd/ls", Name: "main", GoFiles: []string{"ls.go"}},
+		{ID: "example.com/pkg/ls", PkgPath: "example.com/pkg/ls", Name: "ls", GoFiles: []string{"ls.go"}},
+	}, time.Now())
+	done()
+
+	done = r.phase(PhaseRewrite)
+	r.command(PhaseRewrite, "example.com/cmd/ls", time.Now())
+	done()
+
+	want := []Event{
+		{Phase: PhaseLoad},
+		{Phase: PhaseLoad, Command: "example.com/cmd/ls", Done: true},
+		{Phase: PhaseLoad, Done: true},
+		{Phase: PhaseRewrite},
+		{Phase: PhaseRewrite, Command: "example.com/cmd/ls", Done: true},
+		{Phase: PhaseRewrite, Done: true},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("events = %v, want %v", events, want)
+	}
+	for i := range want {
+		if events[i] != want[i] {
+			t.Errorf("event %d = %v, want %v", i, events[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,507 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bb
+
+import (
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/go/packages"
+)
+
+var update = flag.Bool("update", false, "update golden files in testdata/rewrite")
+
+// TestRewriteGolden rewrites the command in each testdata/rewrite/*/in
+// directory and compares the result to testdata/rewrite/*/out.
+func TestRewriteGolden(t *testing.T) {
+	dirs, err := filepath.Glob("testdata/rewrite/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range dirs {
+		dir := dir
+		t.Run(filepath.Base(dir), func(t *testing.T) {
+			in := filepath.Join(dir, "in")
+			infos, err := ioutil.ReadDir(in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, fi := range infos {
+				names = append(names, fi.Name())
+			}
+
+			tmpDir, err := ioutil.TempDir("", "test-golden-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+
+			pkgPath := "example.com/cmd/" + filepath.Base(dir)
+			p := loadTestPackage(t, pkgPath, in, names...)
+			if err := NewPackage(pkgPath, p).Rewrite(tmpDir); err != nil {
+				t.Fatal(err)
+			}
+
+			out := filepath.Join(dir, "out")
+			if *update {
+				if err := os.RemoveAll(out); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.MkdirAll(out, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// The rewritten package must compile.
+			fset := token.NewFileSet()
+			var files []*ast.File
+			for _, name := range names {
+				f, err := parser.ParseFile(fset, filepath.Join(tmpDir, name), nil, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				files = append(files, f)
+			}
+			conf := types.Config{Importer: importer.Default()}
+			if _, err := conf.Check(pkgPath, fset, files, nil); err != nil {
+				t.Errorf("rewritten package does not type-check: %v", err)
+			}
+
+			for _, name := range names {
+				got, err := ioutil.ReadFile(filepath.Join(tmpDir, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				golden := filepath.Join(out, name)
+				if *update {
+					if err := ioutil.WriteFile(golden, got, 0644); err != nil {
+						t.Fatal(err)
+					}
+					continue
+				}
+				want, err := ioutil.ReadFile(golden)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != string(want) {
+					t.Errorf("rewritten %s does not match %s:\n%s", name, golden, got)
+				}
+			}
+		})
+	}
+}
+
+// runGo runs the Go program in dir, using no network.
+func runGo(t *testing.T, dir, pkg string) string {
+	t.Helper()
+	cmd := exec.Command("go", "run", pkg)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GO111MODULE=on", "GOFLAGS=-mod=mod", "GOPROXY=off")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("go run %s in %s: %v\n%s", pkg, dir, err, out)
+	}
+	return string(out)
+}
+
+// TestRewriteInitOrder checks that a rewritten command initializes its
+// package exactly like the Go compiler and runtime do for the original
+// command, even if go/packages handed files to the rewriter out of order.
+func TestRewriteInitOrder(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+
+	for _, tt := range []struct {
+		name  string
+		files map[string]string
+		want  string
+	}{
+		{
+			// Independent variables are initialized in the order
+			// of their files, and init functions run afterwards.
+			name: "fileorder",
+			files: map[string]string{
+				"a.go": `package main
+
+var a = trace("var a")
+
+func init() { trace("init a.go") }
+`,
+				"b.go": `package main
+
+func init() { trace("init b.go") }
+
+var b = trace("var b")
+`,
+				"main.go": `package main
+
+import "fmt"
+
+var order []string
+
+func trace(s string) string {
+	order = append(order, s)
+	return s
+}
+
+func init() { trace("init main.go 1") }
+
+func init() { trace("init main.go 2") }
+
+func main() {
+	fmt.Println(order)
+}
+`,
+			},
+			want: "[var a var b init a.go init b.go init main.go 1 init main.go 2]\n",
+		},
+		{
+			// Dependencies across files, including through
+			// functions and closures, are initialized first.
+			name: "crossfile",
+			files: map[string]string{
+				"a.go": `package main
+
+var x = trace("x", y+z)
+
+var w = func() int { return trace("w", sum()) }()
+`,
+				"b.go": `package main
+
+var y = trace("y", 1)
+
+func sum() int { return x + y + z }
+`,
+				"c.go": `package main
+
+var z = trace("z", 2)
+
+var independent = trace("independent", 0)
+`,
+				"main.go": `package main
+
+import "fmt"
+
+var order []string
+
+func trace(s string, v int) int {
+	order = append(order, fmt.Sprintf("%s=%d", s, v))
+	return v
+}
+
+func main() {
+	fmt.Println(order)
+}
+`,
+			},
+			want: "[y=1 z=2 x=3 w=6 independent=0]\n",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "test-initorder-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			// The original command, built by the Go compiler.
+			src := filepath.Join(dir, "src")
+			tt.files["go.mod"] = "module example.com/original\n"
+			writeTestFiles(t, src, tt.files)
+			if got := runGo(t, src, "."); got != tt.want {
+				t.Fatalf("original command printed %q, want %q", got, tt.want)
+			}
+
+			// Hand the files to the rewriter in reverse order.
+			var names []string
+			for name := range tt.files {
+				if strings.HasSuffix(name, ".go") {
+					names = append(names, name)
+				}
+			}
+			sort.Sort(sort.Reverse(sort.StringSlice(names)))
+			pkgPath := "example.com/cmd/" + tt.name
+			p := loadTestPackage(t, pkgPath, src, names...)
+
+			bb := filepath.Join(dir, "bb")
+			if err := NewPackage(pkgPath, p).Rewrite(filepath.Join(bb, "cmd", tt.name)); err != nil {
+				t.Fatal(err)
+			}
+			writeTestFiles(t, bb, map[string]string{
+				"go.mod": "module example.com\n",
+				"main.go": fmt.Sprintf(`package main
+
+import cmd %q
+
+func main() {
+	cmd.Init()
+	cmd.Main()
+}
+`, pkgPath),
+			})
+			if got := runGo(t, bb, "."); got != tt.want {
+				t.Errorf("rewritten command printed %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestRewriteUnspellableType checks that globals whose type cannot be
+// spelled out in the command are declared with zero values of their type, or
+// keep their initializer if that is not possible.
+func TestRewriteUnspellableType(t *testing.T) {
+	fset := token.NewFileSet()
+	otherFile, err := parser.ParseFile(fset, "other.go", `package other
+
+type hidden struct{ n int }
+
+func New(n int) *hidden { return &hidden{n} }
+
+func (h *hidden) N() int { return h.n }
+
+type Maker struct{}
+
+func (Maker) Make(ns ...int) *hidden { return &hidden{len(ns)} }
+
+type Pair[K comparable, V any] struct {
+	Key K
+	Val V
+}
+
+func MakePair[K comparable, V any](k K, v V) Pair[K, V] { return Pair[K, V]{k, v} }
+`, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := (&types.Config{}).Check("example.com/other", fset, []*ast.File{otherFile}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name      string
+		goVersion string
+		src       string
+		want      []string
+		wantErr   string
+	}{
+		{
+			name: "zero values",
+			src: `package main
+
+import "example.com/other"
+
+var start = 1
+
+var (
+	h = other.New(next())
+	n = h.N()
+	p = other.MakePair("a", 1)
+	m other.Maker
+	k = m.Make(1, 2)
+)
+
+func next() int { return start + 1 }
+
+func main() {}
+`,
+			want: []string{
+				"h = bbZeroOf1_1(other.New)\n",
+				"n int\n",
+				"p other.Pair[string, int]\n",
+				"k = bbZeroOf2v_1(other.Maker.Make)\n",
+				"h = other.New(next())",
+				"n = h.N()",
+				"k = m.Make(1, 2)",
+				"func bbZeroOf1_1[P1, R1 any](func(P1) R1) (r1 R1) {",
+				"func bbZeroOf2v_1[P1, P2, R1 any](func(P1, ...P2) R1) (r1 R1) {",
+			},
+		},
+		{
+			name:      "raised to go1.18",
+			goVersion: "1.16",
+			src: `// Copyright notice.
+
+package main
+
+import "example.com/other"
+
+var (
+	h = other.New(1)
+	n = h.N()
+)
+
+func main() {}
+`,
+			want: []string{
+				"//go:build go1.18\n\n// Copyright notice.\n",
+				"h = bbZeroOf1_1(other.New)\n",
+				"n int\n",
+				"h = other.New(1)",
+				"n = h.N()",
+			},
+		},
+		{
+			name:      "raised to go1.18 with go:build",
+			goVersion: "1.17",
+			src: `//go:build linux || darwin
+
+package main
+
+import "example.com/other"
+
+var h = other.New(1)
+
+func main() {}
+`,
+			want: []string{
+				"//go:build (linux || darwin) && go1.18\n\npackage",
+				"h = bbZeroOf1_1(other.New)\n",
+			},
+		},
+		{
+			name:      "raised to go1.18 with +build",
+			goVersion: "1.16",
+			src: `// +build linux darwin
+// +build !arm
+
+package main
+
+import "example.com/other"
+
+var h = other.New(1)
+
+func main() {}
+`,
+			want: []string{
+				"//go:build (linux || darwin) && !arm && go1.18\n",
+				"h = bbZeroOf1_1(other.New)\n",
+			},
+		},
+		{
+			name: "variables",
+			src: `package main
+
+import "example.com/other"
+
+var start = other.New(1)
+
+var h = start
+
+func main() {}
+`,
+			want: []string{
+				"start = bbZeroOf1_1(other.New)\n",
+				"h = bbZeroOfValue(start)\n",
+				"start = other.New(1)\n",
+				"h = start\n",
+				"Init1()\n\tInit2()\n",
+				"func bbZeroOfValue[T any](T) (t T) {",
+			},
+		},
+		{
+			name: "depends on moved",
+			src: `package main
+
+import "example.com/other"
+
+var start = 1
+
+var h = *other.New(start)
+
+func main() {}
+`,
+			wantErr: "cannot spell out type of global h: hidden is not exported by example.com/other, and its initializer depends on global start",
+		},
+	} {
+		for _, cgo := range []bool{false, true} {
+			name := tt.name
+			if cgo {
+				name += " with cgo"
+			}
+			t.Run(name, func(t *testing.T) {
+				dir, err := ioutil.TempDir("", "test-unspellable-")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer os.RemoveAll(dir)
+
+				p := &packages.Package{
+					Name:    "main",
+					PkgPath: "example.com/cmd/unspellable",
+				}
+				if tt.goVersion != "" {
+					p.Module = &packages.Module{GoVersion: tt.goVersion}
+				}
+				if cgo {
+					// cgo packages are parsed and type-checked by
+					// parseGoFiles.
+					src := strings.Replace(tt.src, "package main\n", "package main\n\nimport \"C\"\n", 1)
+					writeTestFiles(t, dir, map[string]string{"src/main.go": src})
+					p.GoFiles = []string{filepath.Join(dir, "src/main.go")}
+					p.Imports = map[string]*packages.Package{
+						"example.com/other": {PkgPath: "example.com/other", Types: other},
+					}
+					if err := parseGoFiles(p); err != nil {
+						t.Fatal(err)
+					}
+				} else {
+					p.Fset = token.NewFileSet()
+					p.TypesInfo = &types.Info{
+						Types: make(map[ast.Expr]types.TypeAndValue),
+						Defs:  make(map[*ast.Ident]types.Object),
+						Uses:  make(map[*ast.Ident]types.Object),
+
+						Selections: make(map[*ast.SelectorExpr]*types.Selection),
+					}
+					f, err := parser.ParseFile(p.Fset, "main.go", tt.src, parser.ParseComments)
+					if err != nil {
+						t.Fatal(err)
+					}
+					p.Syntax = []*ast.File{f}
+					conf := types.Config{Importer: importerFunc(func(path string) (*types.Package, error) {
+						return other, nil
+					})}
+					if p.Types, err = conf.Check(p.PkgPath, p.Fset, p.Syntax, p.TypesInfo); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				err = NewPackage(p.PkgPath, p).Rewrite(filepath.Join(dir, "dest"))
+				if tt.wantErr != "" {
+					if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+						t.Fatalf("Rewrite() = %v, want error containing %q", err, tt.wantErr)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := ioutil.ReadFile(filepath.Join(dir, "dest", "main.go"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, want := range tt.want {
+					if !strings.Contains(string(got), want) {
+						t.Errorf("rewritten main.go does not contain %q:\n%s", want, got)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bb
+
+import (
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/token"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// RegisterFile is the name of the file that CreateBBMainSourceWithOpts adds
+// to the template. Templates must not have a file of this name, nor files
+// whose names sort after it.
+//
+// Its init function runs after those of the template's files, whose names
+// sort before it.
+const RegisterFile = "zz_bbregister.go"
+
+// templateDecls are the names of a template's top-level functions and
+// variables.
+type templateDecls struct {
+	funcs map[string]bool
+	vars  map[string]bool
+}
+
+// declarations returns the top-level functions and variables of files.
+func declarations(files []*ast.File) templateDecls {
+	d := templateDecls{
+		funcs: make(map[string]bool),
+		vars:  make(map[string]bool),
+	}
+	for _, f := range files {
+		for _, decl := range f.Decls {
+			switch decl := decl.(type) {
+			case *ast.FuncDecl:
+				if decl.Recv == nil {
+					d.funcs[decl.Name.Name] = true
+				}
+			case *ast.GenDecl:
+				if decl.Tok != token.VAR {
+					continue
+				}
+				for _, spec := range decl.Specs {
+					for _, name := range spec.(*ast.ValueSpec).Names {
+						d.vars[name.Name] = true
+					}
+				}
+			}
+		}
+	}
+	return d
+}
+
+// checkTemplate returns an error if the template files do not declare what
+// the registration with opts calls or sets.
+func checkTemplate(fset *token.FileSet, files []*ast.File, opts *MainOpts) error {
+	if len(files) == 0 {
+		return fmt.Errorf("bb cmd template has no files")
+	}
+	for _, f := range files {
+		name := filepath.Base(fset.File(f.Package).Name())
+		if f.Name.Name != "main" {
+			return fmt.Errorf("bb cmd template file %s is package %s, not main", name, f.Name.Name)
+		}
+		if name == RegisterFile {
+			return fmt.Errorf("bb cmd template must not have a file named %s", RegisterFile)
+		}
+		if name > RegisterFile {
+			return fmt.Errorf("bb cmd template file %s sorts after %s, whose init must run last", name, RegisterFile)
+		}
+	}
+
+	d := declarations(files)
+	for _, req := range []struct {
+		need bool
+		decl string
+		isFn bool
+		why  string
+	}{
+		{true, "Register", true, "registers commands"},
+		{len(opts.Aliases) > 0, "RegisterAlias", true, "registers aliases"},
+		{opts.InterceptExit, "Exit", true, "is called by commands that exit with exit interception"},
+		{opts.ExitPanics, "ExitPanics", false, "is set to make exits panic"},
+		{opts.DefaultCommand != "", "DefaultCmd", false, "is set to the default command"},
+	} {
+		if !req.need {
+			continue
+		}
+		if req.isFn && !d.funcs[req.decl] {
+			return fmt.Errorf("bb cmd template has no func %s, which %s", req.decl, req.why)
+		}
+		if !req.isFn && !d.vars[req.decl] {
+			return fmt.Errorf("bb cmd template has no var %s, which %s", req.decl, req.why)
+		}
+	}
+	return nil
+}
+
+// readTemplate returns the Go files of the template in dir that ctxt selects,
+// by file name. Test files are left out.
+func readTemplate(ctxt build.Context, dir string) (map[string][]byte, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string][]byte)
+	for _, fi := range fis {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		if ok, err := ctxt.MatchFile(dir, name); err != nil {
+			return nil, err
+		} else if !ok {
+			continue
+		}
+		if files[name], err = ioutil.ReadFile(filepath.Join(dir, name)); err != nil {
+			return nil, err
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("bb cmd template %s has no Go files", dir)
+	}
+	return files, nil
+}
+
+// writeTemplate writes the template files to dir.
+func writeTemplate(dir string, files map[string][]byte) error {
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), files[name], 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
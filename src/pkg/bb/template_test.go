@@ -0,0 +1,299 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bb
+
+import (
+	"go/build"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// logTemplate is a template of two files, which logs the last two
+// invocations and does not declare RegisterSynopsis.
+var logTemplate = map[string][]byte{
+	"main.go": []byte(`package main
+
+import (
+	"fmt"
+	"os"
+)
+
+var cmds = map[string]func(){}
+
+func Register(name string, init, main func()) {
+	cmds[name] = func() {
+		init()
+		main()
+	}
+}
+
+func main() {
+	logInvocation(os.Args[1])
+	cmd, ok := cmds[os.Args[1]]
+	if !ok {
+		fmt.Printf("no command %s\n", os.Args[1])
+	} else {
+		os.Args = os.Args[1:]
+		cmd()
+	}
+	printLog()
+}
+`),
+	"log.go": []byte(`package main
+
+import "fmt"
+
+var (
+	invocations [2]string
+	next        int
+)
+
+func logInvocation(name string) {
+	invocations[next%len(invocations)] = name
+	next++
+}
+
+func printLog() {
+	fmt.Printf("log: %q\n", invocations)
+}
+`),
+}
+
+func TestCustomTemplate(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+	dir, err := ioutil.TempDir("", "test-template-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bin := buildTestBusyboxTemplate(t, dir, map[string]string{
+		"hello": `// Hello greets.
+package main
+
+import "fmt"
+
+func main() {
+	fmt.Println("hello")
+}
+`,
+	}, &MainOpts{}, logTemplate, map[string]string{})
+
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{args: []string{"hello"}, want: "hello\nlog: [\"hello\" \"\"]\n"},
+		{args: []string{"bye"}, want: "no command bye\nlog: [\"bye\" \"\"]\n"},
+	} {
+		if code, out := runTestBusybox(t, bin, nil, tt.args...); code != 0 || out != tt.want {
+			t.Errorf("bb %v = (%d, %q), want (0, %q)", tt.args, code, out, tt.want)
+		}
+	}
+}
+
+func TestCheckTemplate(t *testing.T) {
+	pkgs := []string{"example.com/cmd/ls"}
+	for _, tt := range []struct {
+		name string
+		tmpl map[string][]byte
+		opts *MainOpts
+		want string
+	}{
+		{
+			name: "default template with all options",
+			tmpl: bbMainTemplate,
+			opts: &MainOpts{
+				InterceptExit:  true,
+				ExitPanics:     true,
+				DefaultCommand: "dir",
+				Aliases:        map[string]string{"dir": "ls"},
+				Synopses:       map[string]string{"ls": "lists files"},
+			},
+		},
+		{
+			name: "template without RegisterSynopsis",
+			tmpl: logTemplate,
+			opts: &MainOpts{Synopses: map[string]string{"ls": "lists files"}},
+		},
+		{
+			name: "no files",
+			tmpl: map[string][]byte{},
+			opts: &MainOpts{},
+			want: "bb cmd template has no files",
+		},
+		{
+			name: "no Register",
+			tmpl: map[string][]byte{"main.go": []byte("package main\n\nfunc main() {}\n")},
+			opts: &MainOpts{},
+			want: "no func Register",
+		},
+		{
+			name: "Register method",
+			tmpl: map[string][]byte{"main.go": []byte("package main\n\ntype t int\n\nfunc (t) Register(string, func(), func()) {}\n\nfunc main() {}\n")},
+			opts: &MainOpts{},
+			want: "no func Register",
+		},
+		{
+			name: "aliases without RegisterAlias",
+			tmpl: logTemplate,
+			opts: &MainOpts{Aliases: map[string]string{"dir": "ls"}},
+			want: "no func RegisterAlias",
+		},
+		{
+			name: "exit interception without Exit",
+			tmpl: logTemplate,
+			opts: &MainOpts{InterceptExit: true},
+			want: "no func Exit",
+		},
+		{
+			name: "exit panics without ExitPanics",
+			tmpl: logTemplate,
+			opts: &MainOpts{ExitPanics: true},
+			want: "no var ExitPanics",
+		},
+		{
+			name: "default command without DefaultCmd",
+			tmpl: logTemplate,
+			opts: &MainOpts{DefaultCommand: "ls"},
+			want: "no var DefaultCmd",
+		},
+		{
+			name: "register file",
+			tmpl: map[string][]byte{
+				"main.go":    logTemplate["main.go"],
+				"log.go":     logTemplate["log.go"],
+				RegisterFile: []byte("package main\n"),
+			},
+			opts: &MainOpts{},
+			want: "must not have a file named " + RegisterFile,
+		},
+		{
+			name: "file sorting after register file",
+			tmpl: map[string][]byte{
+				"main.go": logTemplate["main.go"],
+				"zzz.go":  logTemplate["log.go"],
+			},
+			opts: &MainOpts{},
+			want: "zzz.go sorts after " + RegisterFile,
+		},
+		{
+			name: "not package main",
+			tmpl: map[string][]byte{"bb.go": []byte("package bb\n\nfunc Register(string, func(), func()) {}\n")},
+			opts: &MainOpts{},
+			want: "bb.go is package bb, not main",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "test-template-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			err = CreateBBMainSourceWithOpts(parseTestTemplate(t, tt.tmpl), pkgs, dir, tt.opts)
+			if tt.want == "" && err != nil {
+				t.Errorf("CreateBBMainSourceWithOpts = %v, want nil", err)
+			} else if tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)) {
+				t.Errorf("CreateBBMainSourceWithOpts = %v, want error %q", err, tt.want)
+			}
+			if err != nil {
+				return
+			}
+
+			var want []string
+			for name := range tt.tmpl {
+				want = append(want, name)
+			}
+			want = append(want, RegisterFile)
+			sort.Strings(want)
+			var got []string
+			for name := range readDirFiles(t, dir) {
+				got = append(got, name)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("CreateBBMainSourceWithOpts wrote %v, want %v", got, want)
+			}
+
+			register := readDirFiles(t, dir)[RegisterFile]
+			if hasSynopsis := strings.Contains(register, "RegisterSynopsis("); hasSynopsis != (tt.name != "template without RegisterSynopsis") {
+				t.Errorf("%s calls RegisterSynopsis = %t:\n%s", RegisterFile, hasSynopsis, register)
+			}
+		})
+	}
+}
+
+// readDirFiles returns the contents of the files in dir by name.
+func readDirFiles(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	for _, fi := range fis {
+		b, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[fi.Name()] = string(b)
+	}
+	return files
+}
+
+func TestReadTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-template-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctxt := build.Default
+	ctxt.GOOS = "linux"
+	if _, err := readTemplate(ctxt, dir); err == nil || !strings.Contains(err.Error(), "has no Go files") {
+		t.Errorf("readTemplate(empty dir) = %v, want error about no Go files", err)
+	}
+
+	writeTestFiles(t, dir, map[string]string{
+		"main.go":       "package main\n",
+		"log.go":        "package main\n\n// log\n",
+		"main_test.go":  "package main\n",
+		"README":        "template\n",
+		"sub/x.go":      "package sub\n",
+		"ignored.go":    "//go:build ignore\n\npackage main\n",
+		"x_windows.go":  "package main\n",
+		"asm_linux.s":   "\n",
+		"tagged_foo.go": "//go:build foo\n\npackage main\n",
+	})
+	got, err := readTemplate(ctxt, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]byte{
+		"main.go": []byte("package main\n"),
+		"log.go":  []byte("package main\n\n// log\n"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("readTemplate = %q, want %q", got, want)
+	}
+
+	ctxt.BuildTags = []string{"foo"}
+	if got, err = readTemplate(ctxt, dir); err != nil {
+		t.Fatal(err)
+	}
+	want["tagged_foo.go"] = []byte("//go:build foo\n\npackage main\n")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("readTemplate(tags foo) = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"fmt"
+	str "strings"
+)
+
+type names = []string
+
+var (
+	reader   = str.NewReader("hello")
+	builder  str.Builder
+	list     names = names{"a", "b"}
+	replacer       = str.NewReplacer("a", "b")
+)
+
+func main() {
+	builder.WriteString("hi")
+	fmt.Println(reader.Len(), builder.String(), list, replacer.Replace("abc"))
+}
@@ -0,0 +1,38 @@
+package aliases
+
+import (
+	"fmt"
+	str "strings"
+)
+
+type names = []string
+
+var (
+	reader   *str.Reader
+	builder  str.Builder
+	list     names
+	replacer *str.Replacer
+)
+
+func Main() {
+	builder.WriteString("hi")
+	fmt.Println(reader.Len(), builder.String(), list, replacer.Replace("abc"))
+}
+func Init1() {
+	reader = str.NewReader("hello")
+}
+func Init2() {
+
+	list = names{"a", "b"}
+}
+func Init3() {
+	replacer = str.NewReplacer("a", "b")
+}
+func Init0() {
+	Init1()
+	Init2()
+	Init3()
+}
+func Init() {
+	Init0()
+}
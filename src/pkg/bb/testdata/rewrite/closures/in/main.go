@@ -0,0 +1,21 @@
+package main
+
+import "fmt"
+
+var counter int
+
+var (
+	increment = func() int {
+		counter++
+		return counter
+	}
+	first  = increment()
+	second = func() int { return increment() * 10 }()
+	lazy   = func(n int) func() int {
+		return func() int { return n + counter }
+	}(first)
+)
+
+func main() {
+	fmt.Println(first, second, lazy())
+}
@@ -0,0 +1,43 @@
+package closures
+
+import "fmt"
+
+var counter int
+
+var (
+	increment func() int
+
+	first  int
+	second int
+	lazy   func() int
+)
+
+func Main() {
+	fmt.Println(first, second, lazy())
+}
+func Init1() {
+	increment = func() int {
+		counter++
+		return counter
+	}
+}
+func Init2() {
+	first = increment()
+}
+func Init3() {
+	second = func() int { return increment() * 10 }()
+}
+func Init4() {
+	lazy = func(n int) func() int {
+		return func() int { return n + counter }
+	}(first)
+}
+func Init0() {
+	Init1()
+	Init2()
+	Init3()
+	Init4()
+}
+func Init() {
+	Init0()
+}
@@ -0,0 +1,30 @@
+// Variables are initialized in dependency order, not declaration order.
+package main
+
+import "fmt"
+
+var trace []string
+
+func record(name string, v int) int {
+	trace = append(trace, name)
+	return v
+}
+
+var (
+	a = record("a", b+c)
+	b = record("b", c*2)
+	c = record("c", 1)
+	d = record("d", 4)
+)
+
+func init() {
+	trace = append(trace, "init 1")
+}
+
+func init() {
+	trace = append(trace, "init 2")
+}
+
+func main() {
+	fmt.Println(a, b, c, d, trace)
+}
@@ -0,0 +1,53 @@
+// Variables are initialized in dependency order, not declaration order.
+package initorder
+
+import "fmt"
+
+var trace []string
+
+func record(name string, v int) int {
+	trace = append(trace, name)
+	return v
+}
+
+var (
+	a int
+	b int
+	c int
+	d int
+)
+
+func Init5() {
+	trace = append(trace, "init 1")
+}
+
+func Init6() {
+	trace = append(trace, "init 2")
+}
+
+func Main() {
+	fmt.Println(a, b, c, d, trace)
+}
+func Init1() {
+	a = record("a", b+c)
+}
+func Init2() {
+	b = record("b", c*2)
+}
+func Init3() {
+	c = record("c", 1)
+}
+func Init4() {
+	d = record("d", 4)
+}
+func Init0() {
+	Init3()
+	Init2()
+	Init1()
+	Init4()
+}
+func Init() {
+	Init0()
+	Init5()
+	Init6()
+}
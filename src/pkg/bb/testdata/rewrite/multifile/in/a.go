@@ -0,0 +1,9 @@
+package main
+
+import "fmt"
+
+var fromA = fmt.Sprintf("a sees %q", fromMain)
+
+func init() {
+	fmt.Println("init in a.go")
+}
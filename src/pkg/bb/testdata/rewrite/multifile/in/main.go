@@ -0,0 +1,13 @@
+package main
+
+import "fmt"
+
+var fromMain = "main"
+
+func init() {
+	fmt.Println("init in main.go")
+}
+
+func main() {
+	fmt.Println(fromA)
+}
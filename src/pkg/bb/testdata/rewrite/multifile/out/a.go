@@ -0,0 +1,12 @@
+package multifile
+
+import "fmt"
+
+var fromA string
+
+func Init2() {
+	fmt.Println("init in a.go")
+}
+func Init1() {
+	fromA = fmt.Sprintf("a sees %q", fromMain)
+}
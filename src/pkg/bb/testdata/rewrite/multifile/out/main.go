@@ -0,0 +1,25 @@
+package multifile
+
+import "fmt"
+
+var fromMain string
+
+func Init4() {
+	fmt.Println("init in main.go")
+}
+
+func Main() {
+	fmt.Println(fromA)
+}
+func Init3() {
+	fromMain = "main"
+}
+func Init0() {
+	Init3()
+	Init1()
+}
+func Init() {
+	Init0()
+	Init2()
+	Init4()
+}
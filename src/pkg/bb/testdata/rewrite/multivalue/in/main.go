@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+func pair() (int, string) {
+	return 1, "one"
+}
+
+var (
+	// Assigned at once from one call.
+	number, name = pair()
+	parsed, err  = strconv.Atoi(name)
+
+	// Different types in one spec.
+	count, label = 2, "two" // Counted.
+)
+
+var _, _ = pair()
+
+func main() {
+	fmt.Println(number, name, parsed, err, count, label)
+}
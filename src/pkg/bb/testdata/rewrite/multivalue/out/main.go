@@ -0,0 +1,58 @@
+package multivalue
+
+import (
+	"fmt"
+	"strconv"
+)
+
+func pair() (int, string) {
+	return 1, "one"
+}
+
+var (
+	// Assigned at once from one call.
+	number int
+	name   string
+	parsed int
+	err    error
+
+	// Different types in one spec.
+	count int
+	label string // Counted.
+)
+
+var (
+	_ int
+	_ string
+)
+
+func Main() {
+	fmt.Println(number, name, parsed, err, count, label)
+}
+func Init1() {
+	number, name = pair()
+}
+func Init2() {
+	parsed, err = strconv.Atoi(name)
+}
+func Init3() {
+
+	count = 2
+}
+func Init4() {
+	label = "two"
+}
+func Init5() {
+
+	_, _ = pair()
+}
+func Init0() {
+	Init1()
+	Init2()
+	Init3()
+	Init4()
+	Init5()
+}
+func Init() {
+	Init0()
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sync/atomic"
+)
+
+type box[T any] struct{ v T }
+
+var (
+	// hash.Hash, which this file does not import.
+	hasher  = sha256.New()
+	handler = func(name string, n ...int) (ok bool) { return len(n) > 0 }
+	tagged  = struct {
+		Name string `json:"name"`
+	}{"x"}
+	pointer = new(atomic.Pointer[box[string]])
+	boxed   = box[int]{1}
+	empty   = struct{}{}
+	iface   = interface{ String() string }(nil)
+	recv    = make(<-chan int)
+)
+
+func main() {
+	fmt.Println(hasher, handler, tagged, pointer, boxed, empty, iface, recv)
+}
@@ -0,0 +1,68 @@
+package typeexprs
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"sync/atomic"
+)
+
+type box[T any] struct{ v T }
+
+var (
+	// hash.Hash, which this file does not import.
+	hasher  hash.Hash
+	handler func(name string, n ...int) (ok bool)
+	tagged  struct {
+		Name string `json:"name"`
+	}
+
+	pointer *atomic.Pointer[box[string]]
+	boxed   box[int]
+	empty   struct{}
+	iface   interface{ String() string }
+	recv    <-chan int
+)
+
+func Main() {
+	fmt.Println(hasher, handler, tagged, pointer, boxed, empty, iface, recv)
+}
+func Init1() {
+	hasher = sha256.New()
+}
+func Init2() {
+	handler = func(name string, n ...int) (ok bool) { return len(n) > 0 }
+}
+func Init3() {
+	tagged = struct {
+		Name string `json:"name"`
+	}{"x"}
+}
+func Init4() {
+	pointer = new(atomic.Pointer[box[string]])
+}
+func Init5() {
+	boxed = box[int]{1}
+}
+func Init6() {
+	empty = struct{}{}
+}
+func Init7() {
+	iface = interface{ String() string }(nil)
+}
+func Init8() {
+	recv = make(<-chan int)
+}
+func Init0() {
+	Init1()
+	Init2()
+	Init3()
+	Init4()
+	Init5()
+	Init6()
+	Init7()
+	Init8()
+}
+func Init() {
+	Init0()
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+type point struct{ x, y int }
+
+var (
+	untypedInt          = 1
+	untypedFloat        = 1.5
+	typedInt      int64 = 2
+	noValue       string
+	same1, same2  = 3, 4
+	structLiteral = point{1, 2}
+	pointer       = &point{3, 4}
+	slice         = []point{{5, 6}}
+	mapLiteral    = map[string][]int{"a": {1}}
+	stdlib        = os.Stdout
+	channel       = make(chan struct{}, 1)
+)
+
+const constant = 10
+
+var fromConst = constant * 2
+
+func main() {
+	fmt.Println(untypedInt, untypedFloat, typedInt, noValue, same1, same2, structLiteral, pointer, slice, mapLiteral, stdlib, channel, fromConst)
+}
@@ -0,0 +1,85 @@
+package types
+
+import (
+	"fmt"
+	"os"
+)
+
+type point struct{ x, y int }
+
+var (
+	untypedInt    int
+	untypedFloat  float64
+	typedInt      int64
+	noValue       string
+	same1, same2  int
+	structLiteral point
+	pointer       *point
+	slice         []point
+	mapLiteral    map[string][]int
+	stdlib        *os.File
+	channel       chan struct{}
+)
+
+const constant = 10
+
+var fromConst int
+
+func Main() {
+	fmt.Println(untypedInt, untypedFloat, typedInt, noValue, same1, same2, structLiteral, pointer, slice, mapLiteral, stdlib, channel, fromConst)
+}
+func Init1() {
+	untypedInt = 1
+}
+func Init2() {
+	untypedFloat = 1.5
+}
+func Init3() {
+	typedInt = 2
+}
+func Init4() {
+
+	same1 = 3
+}
+func Init5() {
+	same2 = 4
+}
+func Init6() {
+	structLiteral = point{1, 2}
+}
+func Init7() {
+	pointer = &point{3, 4}
+}
+func Init8() {
+	slice = []point{{5, 6}}
+}
+func Init9() {
+	mapLiteral = map[string][]int{"a": {1}}
+}
+func Init10() {
+	stdlib = os.Stdout
+}
+func Init11() {
+	channel = make(chan struct{}, 1)
+}
+func Init12() {
+
+	fromConst = constant * 2
+}
+func Init0() {
+	Init1()
+	Init2()
+	Init3()
+	Init4()
+	Init5()
+	Init6()
+	Init7()
+	Init8()
+	Init9()
+	Init10()
+	Init11()
+	Init12()
+}
+func Init() {
+	Init0()
+}
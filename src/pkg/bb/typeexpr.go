@@ -0,0 +1,374 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bb
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"strconv"
+
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+// typeNamer builds AST expressions that denote types in one file of a
+// command.
+//
+// Types may come from packages the file does not import, e.g. when a global
+// is initialized with the result of a function whose result type is declared
+// in a dependency of a dependency. Such packages are imported by addImports.
+type typeNamer struct {
+	p *Package
+	f *ast.File
+
+	// names maps import paths to their names in f.
+	names map[string]string
+
+	// pending are the imports of expressions not yet committed, mapping
+	// import paths to names.
+	pending map[string]string
+
+	// added are the committed imports that f lacks, mapping import paths to
+	// names.
+	added map[string]string
+
+	// pkgNames maps import paths to package names.
+	pkgNames map[string]string
+
+	// pos is the position of the declaration that types are spelled out
+	// for. Braces of structs and interfaces are put there, so that small
+	// ones are printed on one line.
+	pos token.Pos
+}
+
+func newTypeNamer(p *Package, f *ast.File) *typeNamer {
+	n := &typeNamer{
+		p:        p,
+		f:        f,
+		names:    make(map[string]string),
+		pending:  make(map[string]string),
+		added:    make(map[string]string),
+		pkgNames: make(map[string]string),
+	}
+	for _, impt := range f.Imports {
+		path, err := strconv.Unquote(impt.Path.Value)
+		if err != nil {
+			continue
+		}
+		if impt.Name == nil {
+			if pkg := n.importedPackage(path); pkg != nil {
+				n.names[path] = pkg.Name()
+			}
+		} else if impt.Name.Name != "_" {
+			n.names[path] = impt.Name.Name
+		}
+	}
+	return n
+}
+
+// importedPackage returns the package of p that path refers to, or nil.
+func (n *typeNamer) importedPackage(path string) *types.Package {
+	if n.p.Pkg.Types == nil {
+		return nil
+	}
+	for _, pkg := range n.p.Pkg.Types.Imports() {
+		if pkg.Path() == path {
+			return pkg
+		}
+	}
+	return nil
+}
+
+// inUse returns true if name is declared in f's file or package scope.
+func (n *typeNamer) inUse(name string) bool {
+	for _, used := range n.names {
+		if used == name {
+			return true
+		}
+	}
+	for _, used := range n.pending {
+		if used == name {
+			return true
+		}
+	}
+	return n.p.Pkg.Types != nil && n.p.Pkg.Types.Scope().Lookup(name) != nil
+}
+
+// qualify returns the name under which pkg can be referred to in f,
+// importing it if necessary.
+func (n *typeNamer) qualify(pkg *types.Package) string {
+	if name, ok := n.names[pkg.Path()]; ok {
+		return name
+	}
+	if name, ok := n.pending[pkg.Path()]; ok {
+		return name
+	}
+	n.pkgNames[pkg.Path()] = pkg.Name()
+	name := pkg.Name()
+	for i := 1; n.inUse(name); i++ {
+		name = fmt.Sprintf("%s%d", pkg.Name(), i)
+	}
+	n.pending[pkg.Path()] = name
+	return name
+}
+
+// commit marks the imports used by the expressions returned so far to be
+// added to f.
+func (n *typeNamer) commit() {
+	for path, name := range n.pending {
+		n.names[path] = name
+		n.added[path] = name
+	}
+	n.pending = make(map[string]string)
+}
+
+// discard forgets the imports used by the expressions returned since the last
+// commit.
+func (n *typeNamer) discard() {
+	n.pending = make(map[string]string)
+}
+
+// addImports adds the committed imports to f.
+func (n *typeNamer) addImports(fset *token.FileSet) {
+	for path, name := range n.added {
+		if n.pkgNames[path] == name {
+			astutil.AddImport(fset, n.f, path)
+		} else {
+			astutil.AddNamedImport(fset, n.f, name, path)
+		}
+	}
+	n.added = make(map[string]string)
+}
+
+// typeName returns an expression for the type named obj.
+func (n *typeNamer) typeName(obj *types.TypeName) (ast.Expr, error) {
+	switch {
+	case obj.Pkg() == nil:
+		// Universe types, e.g. error.
+		if n.inUse(obj.Name()) {
+			return nil, fmt.Errorf("%s is shadowed", obj.Name())
+		}
+		return ast.NewIdent(obj.Name()), nil
+
+	case obj.Pkg() == n.p.Pkg.Types:
+		if obj.Parent() != obj.Pkg().Scope() {
+			return nil, fmt.Errorf("%s is declared inside a function", obj.Name())
+		}
+		return ast.NewIdent(obj.Name()), nil
+
+	case !obj.Exported():
+		return nil, fmt.Errorf("%s is not exported by %s", obj.Name(), obj.Pkg().Path())
+
+	case n.names[obj.Pkg().Path()] == ".":
+		return ast.NewIdent(obj.Name()), nil
+	}
+	return &ast.SelectorExpr{
+		X:   ast.NewIdent(n.qualify(obj.Pkg())),
+		Sel: ast.NewIdent(obj.Name()),
+	}, nil
+}
+
+// instance returns an expression for the type named obj instantiated with
+// typeArgs.
+func (n *typeNamer) instance(obj *types.TypeName, typeArgs *types.TypeList) (ast.Expr, error) {
+	x, err := n.typeName(obj)
+	if err != nil || typeArgs.Len() == 0 {
+		return x, err
+	}
+	var indices []ast.Expr
+	for i := 0; i < typeArgs.Len(); i++ {
+		index, err := n.expr(typeArgs.At(i))
+		if err != nil {
+			return nil, err
+		}
+		indices = append(indices, index)
+	}
+	if len(indices) == 1 {
+		return &ast.IndexExpr{X: x, Index: indices[0]}, nil
+	}
+	return &ast.IndexListExpr{X: x, Indices: indices}, nil
+}
+
+// fields returns a field list for the variables of a tuple.
+func (n *typeNamer) fields(t *types.Tuple, variadic bool) (*ast.FieldList, error) {
+	fl := &ast.FieldList{}
+	for i := 0; i < t.Len(); i++ {
+		v := t.At(i)
+		typ, err := n.expr(v.Type())
+		if err != nil {
+			return nil, err
+		}
+		if variadic && i == t.Len()-1 {
+			typ = &ast.Ellipsis{Elt: typ.(*ast.ArrayType).Elt}
+		}
+		field := &ast.Field{Type: typ}
+		if v.Name() != "" {
+			field.Names = []*ast.Ident{ast.NewIdent(v.Name())}
+		}
+		fl.List = append(fl.List, field)
+	}
+	return fl, nil
+}
+
+// unexported returns an error if obj is not exported by a package other than
+// the command, because a type with such a field or method cannot be spelled
+// outside of that package.
+func (n *typeNamer) unexported(obj types.Object) error {
+	if obj.Pkg() != nil && obj.Pkg() != n.p.Pkg.Types && !obj.Exported() {
+		return fmt.Errorf("%s is not exported by %s", obj.Name(), obj.Pkg().Path())
+	}
+	return nil
+}
+
+// expr returns an expression that denotes t in the file, or an error if t
+// cannot be spelled there.
+func (n *typeNamer) expr(t types.Type) (ast.Expr, error) {
+	switch t := t.(type) {
+	case *types.Basic:
+		if t.Kind() == types.UnsafePointer {
+			return &ast.SelectorExpr{X: ast.NewIdent(n.qualify(types.Unsafe)), Sel: ast.NewIdent("Pointer")}, nil
+		}
+		if t.Info()&types.IsUntyped != 0 || t.Kind() == types.Invalid {
+			return nil, fmt.Errorf("%s has no type", t)
+		}
+		if n.inUse(t.Name()) {
+			return nil, fmt.Errorf("%s is shadowed", t.Name())
+		}
+		return ast.NewIdent(t.Name()), nil
+
+	case *types.Named:
+		return n.instance(t.Obj(), t.TypeArgs())
+
+	case *types.Alias:
+		pending := make(map[string]string)
+		for path, name := range n.pending {
+			pending[path] = name
+		}
+		if x, err := n.instance(t.Obj(), t.TypeArgs()); err == nil {
+			return x, nil
+		}
+		// The aliased type may still be spelled out.
+		n.pending = pending
+		return n.expr(types.Unalias(t))
+
+	case *types.Pointer:
+		x, err := n.expr(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return &ast.StarExpr{X: x}, nil
+
+	case *types.Slice:
+		x, err := n.expr(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return &ast.ArrayType{Elt: x}, nil
+
+	case *types.Array:
+		x, err := n.expr(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return &ast.ArrayType{
+			Len: &ast.BasicLit{Kind: token.INT, Value: strconv.FormatInt(t.Len(), 10)},
+			Elt: x,
+		}, nil
+
+	case *types.Map:
+		k, err := n.expr(t.Key())
+		if err != nil {
+			return nil, err
+		}
+		v, err := n.expr(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return &ast.MapType{Key: k, Value: v}, nil
+
+	case *types.Chan:
+		x, err := n.expr(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		dir := ast.SEND | ast.RECV
+		switch t.Dir() {
+		case types.SendOnly:
+			dir = ast.SEND
+		case types.RecvOnly:
+			dir = ast.RECV
+		}
+		return &ast.ChanType{Dir: dir, Value: x}, nil
+
+	case *types.Signature:
+		if t.TypeParams().Len() > 0 {
+			return nil, fmt.Errorf("%s is generic", t)
+		}
+		params, err := n.fields(t.Params(), t.Variadic())
+		if err != nil {
+			return nil, err
+		}
+		results, err := n.fields(t.Results(), false)
+		if err != nil {
+			return nil, err
+		}
+		if len(results.List) == 0 {
+			results = nil
+		}
+		return &ast.FuncType{Params: params, Results: results}, nil
+
+	case *types.Struct:
+		fl := &ast.FieldList{}
+		for i := 0; i < t.NumFields(); i++ {
+			v := t.Field(i)
+			if err := n.unexported(v); err != nil {
+				return nil, err
+			}
+			typ, err := n.expr(v.Type())
+			if err != nil {
+				return nil, err
+			}
+			field := &ast.Field{Type: typ}
+			if !v.Embedded() {
+				field.Names = []*ast.Ident{ast.NewIdent(v.Name())}
+			}
+			if tag := t.Tag(i); tag != "" {
+				quoted := strconv.Quote(tag)
+				if strconv.CanBackquote(tag) {
+					quoted = "`" + tag + "`"
+				}
+				field.Tag = &ast.BasicLit{Kind: token.STRING, Value: quoted}
+			}
+			fl.List = append(fl.List, field)
+		}
+		fl.Opening, fl.Closing = n.pos, n.pos
+		return &ast.StructType{Fields: fl}, nil
+
+	case *types.Interface:
+		fl := &ast.FieldList{}
+		for i := 0; i < t.NumEmbeddeds(); i++ {
+			typ, err := n.expr(t.EmbeddedType(i))
+			if err != nil {
+				return nil, err
+			}
+			fl.List = append(fl.List, &ast.Field{Type: typ})
+		}
+		for i := 0; i < t.NumExplicitMethods(); i++ {
+			m := t.ExplicitMethod(i)
+			if err := n.unexported(m); err != nil {
+				return nil, err
+			}
+			typ, err := n.expr(m.Type())
+			if err != nil {
+				return nil, err
+			}
+			fl.List = append(fl.List, &ast.Field{Names: []*ast.Ident{ast.NewIdent(m.Name())}, Type: typ})
+		}
+		fl.Opening, fl.Closing = n.pos, n.pos
+		return &ast.InterfaceType{Methods: fl}, nil
+	}
+	return nil, fmt.Errorf("type %s cannot be spelled out", t)
+}
@@ -6,6 +6,7 @@
 package golang
 
 import (
+	"context"
 	"fmt"
 	"go/build"
 	"os"
@@ -31,7 +32,13 @@ func Default() Environ {
 
 // GoCmd runs a go command in the environment.
 func (c Environ) GoCmd(args ...string) *exec.Cmd {
-	cmd := exec.Command(filepath.Join(c.GOROOT, "bin", "go"), args...)
+	return c.GoCmdContext(context.Background(), args...)
+}
+
+// GoCmdContext is like GoCmd, but the go command is killed if ctx is done
+// before it exits.
+func (c Environ) GoCmdContext(ctx context.Context, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, filepath.Join(c.GOROOT, "bin", "go"), args...)
 	cmd.Env = append(os.Environ(), c.Env()...)
 	return cmd
 }
@@ -111,6 +118,12 @@ type BuildOpts struct {
 // BuildDir compiles the package in the directory `dirPath`, writing the build
 // object to `binaryPath`.
 func (c Environ) BuildDir(dirPath string, binaryPath string, opts BuildOpts) error {
+	return c.BuildDirContext(context.Background(), dirPath, binaryPath, opts)
+}
+
+// BuildDirContext is like BuildDir, but stops the build if ctx is done
+// before it completes.
+func (c Environ) BuildDirContext(ctx context.Context, dirPath string, binaryPath string, opts BuildOpts) error {
 	args := []string{
 		"build",
 
@@ -141,11 +154,16 @@ func (c Environ) BuildDir(dirPath string, binaryPath string, opts BuildOpts) err
 	// We always set the working directory, so this is always '.'.
 	args = append(args, ".")
 
-	cmd := c.GoCmd(args...)
+	cmd := c.GoCmdContext(ctx, args...)
 	cmd.Dir = dirPath
 
-	if o, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("error building go package in %q: %v, %v", dirPath, string(o), err)
+	o, err := cmd.CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	// A build killed because ctx is done fails as well.
+	if ctx.Err() != nil {
+		return fmt.Errorf("error building go package in %q: %v, %w", dirPath, string(o), ctx.Err())
 	}
-	return nil
+	return fmt.Errorf("error building go package in %q: %v, %v", dirPath, string(o), err)
 }
@@ -0,0 +1,90 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monoimporter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/build"
+	"io"
+	"strings"
+
+	"github.com/u-root/gobusybox/src/pkg/golang"
+)
+
+// NewFromExports returns a new importer that reads the export data of each
+// import path from the file exports maps it to, e.g. as returned by
+// ExportsFromGoList.
+func NewFromExports(exports map[string]string) *Importer {
+	i := New(build.Default, nil, nil)
+	i.AddExports(exports)
+	return i
+}
+
+// AddExports makes the importer read the export data of each import path in
+// exports from the file it maps to, in preference to any archive.
+func (i *Importer) AddExports(exports map[string]string) {
+	for importPath, file := range exports {
+		i.exports[importPath] = file
+	}
+}
+
+// ParseImportMap parses import map entries of the form importpath=file, as
+// passed by build systems that know the export data file of every
+// dependency.
+//
+// It is an error to map an import path to two different files.
+func ParseImportMap(entries []string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, entry := range entries {
+		idx := strings.Index(entry, "=")
+		if idx <= 0 || idx == len(entry)-1 {
+			return nil, fmt.Errorf("import map entry %q is not of the form importpath=file", entry)
+		}
+		importPath, file := entry[:idx], entry[idx+1:]
+		if f, ok := m[importPath]; ok && f != file {
+			return nil, fmt.Errorf("import path %q maps to both %s and %s", importPath, f, file)
+		}
+		m[importPath] = file
+	}
+	return m, nil
+}
+
+// ExportsFromGoList builds the packages matching patterns and their
+// dependencies, including the standard library, with `go list -export` in
+// dir, and returns a map of import paths to their export data files.
+//
+// Unlike precompiled archives in GOROOT, which newer Go toolchains no longer
+// ship, this works with any toolchain and export data format.
+func ExportsFromGoList(env golang.Environ, dir string, patterns ...string) (map[string]string, error) {
+	args := append([]string{"list", "-export", "-deps", "-json", "--"}, patterns...)
+	cmd := env.GoCmd(args...)
+	cmd.Dir = dir
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("go list -export %v: %v: %s", patterns, err, stderr.String())
+	}
+
+	exports := make(map[string]string)
+	dec := json.NewDecoder(&stdout)
+	for {
+		var p struct {
+			ImportPath string
+			Export     string
+		}
+		if err := dec.Decode(&p); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("go list -export %v: %v", patterns, err)
+		}
+		// unsafe has no export data.
+		if p.Export != "" {
+			exports[p.ImportPath] = p.Export
+		}
+	}
+	return exports, nil
+}
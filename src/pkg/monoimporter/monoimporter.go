@@ -7,32 +7,35 @@ import (
 	"fmt"
 	"go/ast"
 	"go/build"
+	"go/importer"
 	"go/parser"
 	"go/token"
 	"go/types"
 	"io"
-	"log"
 	"os"
 	"path"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 
-	"golang.org/x/tools/go/gcexportdata"
 	"golang.org/x/tools/go/packages"
 )
 
 type finder interface {
-	findAndOpen(pkg string) io.ReadCloser
+	// findAndOpen opens the export data of pkg, or returns nil if it is
+	// not found.
+	findAndOpen(pkg string) (io.ReadCloser, error)
 }
 
-func find(finders []finder, pkg string) io.ReadCloser {
+func find(finders []finder, pkg string) (io.ReadCloser, error) {
 	for _, f := range finders {
-		if file := f.findAndOpen(pkg); file != nil {
-			return file
+		file, err := f.findAndOpen(pkg)
+		if err != nil || file != nil {
+			return file, err
 		}
 	}
-	return nil
+	return nil, nil
 }
 
 type zipReader struct {
@@ -65,17 +68,13 @@ func thatOneString(ctxt build.Context) string {
 	return fmt.Sprintf("%s_%s%s", ctxt.GOOS, ctxt.GOARCH, suffix)
 }
 
-func (z *zipReader) findAndOpen(pkg string) io.ReadCloser {
+func (z *zipReader) findAndOpen(pkg string) (io.ReadCloser, error) {
 	name := fmt.Sprintf("%s/%s.x", thatOneString(z.ctxt), pkg)
 	f, ok := z.files[name]
 	if !ok {
-		return nil
-	}
-	rc, err := f.Open()
-	if err != nil {
-		return nil
+		return nil, nil
 	}
-	return rc
+	return f.Open()
 }
 
 type archives struct {
@@ -83,15 +82,38 @@ type archives struct {
 	archs []string
 }
 
-func (a archives) findAndOpen(pkg string) io.ReadCloser {
-	suffixes := []string{
-		// bazel
-		fmt.Sprintf("/%s.x", path.Base(pkg)),
-		fmt.Sprintf("/%s.a", path.Base(pkg)),
-		// blaze
-		fmt.Sprintf("/%s.x", pkg),
-		fmt.Sprintf("/%s.a", pkg),
+// match returns the archives whose path ends in one of the suffixes, without
+// their extension, as blaze passes both pkg.x and pkg.a for each package.
+func (a archives) match(suffixes ...string) []string {
+	var matches []string
+	seen := make(map[string]bool)
+	for _, s := range a.archs {
+		for _, suffix := range suffixes {
+			if !strings.HasSuffix(s, suffix) {
+				continue
+			}
+			if name := strings.TrimSuffix(s, filepath.Ext(s)); !seen[name] {
+				seen[name] = true
+				matches = append(matches, name)
+			}
+		}
 	}
+	return matches
+}
+
+// openArchive opens name.x, or name.a if there is no name.x.
+func (a archives) openArchive(name string) (io.ReadCloser, error) {
+	for _, s := range a.archs {
+		if s == name+".x" {
+			return os.Open(s)
+		}
+	}
+	return os.Open(name + ".a")
+}
+
+// inDir opens the archive of pkg in one of the archive directories, laid out
+// as GOOS_GOARCH/pkg.a.
+func (a archives) inDir(pkg string) io.ReadCloser {
 	for _, s := range a.archs {
 		if fi, err := os.Stat(s); err == nil && fi.IsDir() {
 			name := fmt.Sprintf("%s/%s.a", thatOneString(a.ctxt), pkg)
@@ -100,19 +122,40 @@ func (a archives) findAndOpen(pkg string) io.ReadCloser {
 				return f
 			}
 		}
-		for _, suffix := range suffixes {
-			if strings.HasSuffix(s, suffix) {
-				ar, err := os.Open(s)
-				if err != nil {
-					return nil
-				}
-				return ar
-			}
-		}
 	}
 	return nil
 }
 
+// has returns true if pkg is found by its full import path.
+func (a archives) has(pkg string) bool {
+	if f := a.inDir(pkg); f != nil {
+		f.Close()
+		return true
+	}
+	return len(a.match(fmt.Sprintf("/%s.x", pkg), fmt.Sprintf("/%s.a", pkg))) > 0
+}
+
+func (a archives) findAndOpen(pkg string) (io.ReadCloser, error) {
+	if f := a.inDir(pkg); f != nil {
+		return f, nil
+	}
+	for _, suffixes := range [][]string{
+		// blaze
+		{fmt.Sprintf("/%s.x", pkg), fmt.Sprintf("/%s.a", pkg)},
+		// bazel
+		{fmt.Sprintf("/%s.x", path.Base(pkg)), fmt.Sprintf("/%s.a", path.Base(pkg))},
+	} {
+		switch matches := a.match(suffixes...); len(matches) {
+		case 0:
+		case 1:
+			return a.openArchive(matches[0])
+		default:
+			return nil, fmt.Errorf("package %q is ambiguous: archives %s all match, use an import map", pkg, strings.Join(matches, ", "))
+		}
+	}
+	return nil, nil
+}
+
 // Importer implements a go/types.Importer for bazel-like monorepo build
 // systems for Go packages.
 //
@@ -120,11 +163,19 @@ func (a archives) findAndOpen(pkg string) io.ReadCloser {
 // bazel-like build systems such as blaze or buck rely on a monorepo-style
 // package search instead of using GOPATH and standard library packages are
 // found in a zipped archive instead of GOROOT.
+//
+// Export data is decoded by the standard library's gc importer, so it must
+// have been written by the Go toolchain the importer is built with, or a
+// compatible one. That includes unified IR export data.
 type Importer struct {
 	fset *token.FileSet
 
-	// imports is a cache of imported packages.
-	imports map[string]*types.Package
+	// gc decodes export data found by lookup, and caches imported
+	// packages.
+	gc types.Importer
+
+	// exports maps import paths to export data files.
+	exports map[string]string
 
 	// archives is a list of paths to compiled Go package archives.
 	archives archives
@@ -149,7 +200,7 @@ func NewFromZips(ctxt build.Context, archives []string, zips []string) (*Importe
 	wantPattern := fmt.Sprintf("%s.x.zip", thatOneString(ctxtWithWildcard))
 	for _, dir := range zips {
 		if matched, err := filepath.Match(wantPattern, filepath.Base(dir)); err != nil {
-			log.Printf("Error with pattern %q: %v", wantPattern, err)
+			return nil, fmt.Errorf("error with pattern %q: %v", wantPattern, err)
 		} else if matched {
 			stdlibZ, err := zip.OpenReader(dir)
 			if err != nil {
@@ -172,10 +223,8 @@ func NewFromZips(ctxt build.Context, archives []string, zips []string) (*Importe
 // New returns a new monorepo importer.
 func New(ctxt build.Context, archs []string, stdlib *zip.Reader) *Importer {
 	i := &Importer{
-		imports: map[string]*types.Package{
-			"unsafe": types.Unsafe,
-		},
-		fset: token.NewFileSet(),
+		fset:    token.NewFileSet(),
+		exports: make(map[string]string),
 		archives: archives{
 			ctxt:  ctxt,
 			archs: archs,
@@ -184,13 +233,14 @@ func New(ctxt build.Context, archs []string, stdlib *zip.Reader) *Importer {
 	if stdlib != nil {
 		i.stdlib = newZipReader(stdlib, ctxt)
 	}
+	i.gc = importer.ForCompiler(i.fset, "gc", i.lookup)
 	return i
 }
 
-// Import implements types.Importer.Import.
-func (i *Importer) Import(importPath string) (*types.Package, error) {
-	if pkg, ok := i.imports[importPath]; ok && pkg.Complete() {
-		return pkg, nil
+// lookup opens the export data of importPath.
+func (i *Importer) lookup(importPath string) (io.ReadCloser, error) {
+	if file, ok := i.exports[importPath]; ok {
+		return os.Open(file)
 	}
 
 	pkg := strings.TrimPrefix(importPath, "google3/")
@@ -198,27 +248,104 @@ func (i *Importer) Import(importPath string) (*types.Package, error) {
 	if i.stdlib != nil {
 		finders = append(finders, i.stdlib)
 	}
-	file := find(finders, pkg)
+	file, err := find(finders, pkg)
+	if err != nil {
+		return nil, err
+	}
 	if file == nil {
 		return nil, fmt.Errorf("package %q not found", importPath)
 	}
-	defer file.Close()
+	return file, nil
+}
 
-	r, err := gcexportdata.NewReader(file)
-	if err != nil {
-		return nil, err
+// has returns true if the package importPath is known by its full path.
+func (i *Importer) has(importPath string) bool {
+	if _, ok := i.exports[importPath]; ok {
+		return true
+	}
+	return i.archives.has(strings.TrimPrefix(importPath, "google3/"))
+}
+
+// resolve returns the path of the package that importPath refers to when
+// imported from a package in directory dir, which is the innermost vendored
+// copy of it, if any.
+//
+// dir is a file system path, of which any suffix may be the import path of
+// the importing package, e.g. dir /src/example.com/cmd and import path x/y
+// may refer to example.com/cmd/vendor/x/y or cmd/vendor/x/y.
+func (i *Importer) resolve(importPath, dir string) string {
+	if dir == "" || strings.HasPrefix(importPath, ".") {
+		return importPath
+	}
+	for d := filepath.ToSlash(filepath.Clean(dir)); ; d = path.Dir(d) {
+		for suffix := strings.TrimPrefix(d, "/"); suffix != "" && suffix != "."; {
+			if vendored := path.Join(suffix, "vendor", importPath); i.has(vendored) {
+				return vendored
+			}
+			slash := strings.Index(suffix, "/")
+			if slash < 0 {
+				break
+			}
+			suffix = suffix[slash+1:]
+		}
+		if d == "/" || d == "." {
+			break
+		}
 	}
-	return gcexportdata.Read(r, i.fset, i.imports, importPath)
+	return importPath
 }
 
-// Load loads a google3 package.
+// Import implements types.Importer.Import.
+func (i *Importer) Import(importPath string) (*types.Package, error) {
+	return i.gc.Import(importPath)
+}
+
+// ImportFrom implements types.ImporterFrom.ImportFrom.
+//
+// Vendored packages are resolved relative to dir, the directory of the
+// importing package.
+func (i *Importer) ImportFrom(importPath, dir string, mode types.ImportMode) (*types.Package, error) {
+	if mode != 0 {
+		return nil, fmt.Errorf("import mode %v not supported", mode)
+	}
+	return i.gc.Import(i.resolve(importPath, dir))
+}
+
+// LoadOpts configures LoadWithOpts.
+type LoadOpts struct {
+	// Name is the package name of the files to load. Files of other
+	// packages, e.g. external tests, are ignored. Defaults to main.
+	Name string
+
+	// Info receives the type information of the package. Only the maps
+	// that are non-nil are filled in, as with types.Config.Check. If nil,
+	// all of Types, Defs, Uses, Implicits, Selections and Scopes are
+	// filled in. InitOrder is always filled in.
+	Info *types.Info
+}
+
+// Load loads a google3 main package.
 func Load(pkgPath string, filepaths []string, importer types.Importer) (*packages.Package, error) {
+	return LoadWithOpts(pkgPath, filepaths, importer, &LoadOpts{})
+}
+
+// LoadWithOpts loads a google3 package with the given options.
+//
+// The package is type-checked including function bodies, so that its
+// TypesInfo is as complete as one loaded by go/packages.
+func LoadWithOpts(pkgPath string, filepaths []string, importer types.Importer, opts *LoadOpts) (*packages.Package, error) {
+	name := opts.Name
+	if name == "" {
+		name = "main"
+	}
 	p := &packages.Package{
+		Name:    name,
 		PkgPath: pkgPath,
+		Imports: make(map[string]*packages.Package),
 	}
 
 	// If go_binary, bla, if go_library, bla
-	fset, astFiles, parsedFileNames, err := ParseAST("main", filepaths)
+	fset, astFiles, parsedFileNames, err := ParseAST(name, filepaths)
 	if err != nil {
 		return nil, err
 	}
@@ -232,14 +359,23 @@ func Load(pkgPath string, filepaths []string, importer types.Importer) (*package
 	// some statements.
 	conf := types.Config{
 		Importer: importer,
-
-		// We only need global declarations' types.
-		IgnoreFuncBodies: true,
+		// The rewrite keeps `import "C"` preambles, and cgo runs when
+		// the rewritten package is compiled.
+		FakeImportC: true,
 	}
 
-	p.TypesInfo = &types.Info{
-		// If you don't make this map before passing TypesInfo to Check, it won't be filled in.
-		Types: make(map[ast.Expr]types.TypeAndValue),
+	p.TypesInfo = opts.Info
+	if p.TypesInfo == nil {
+		p.TypesInfo = &types.Info{
+			// If you don't make these maps before passing TypesInfo
+			// to Check, they won't be filled in.
+			Types:      make(map[ast.Expr]types.TypeAndValue),
+			Defs:       make(map[*ast.Ident]types.Object),
+			Uses:       make(map[*ast.Ident]types.Object),
+			Implicits:  make(map[ast.Node]types.Object),
+			Selections: make(map[*ast.SelectorExpr]*types.Selection),
+			Scopes:     make(map[ast.Node]*types.Scope),
+		}
 	}
 	// It's important that p.Syntax be in the same order every time for
 	// p.TypesInfo to be stable.
@@ -248,10 +384,48 @@ func Load(pkgPath string, filepaths []string, importer types.Importer) (*package
 		return nil, fmt.Errorf("type checking failed: %v", err)
 	}
 	p.Types = tpkg
+
+	// Record imports by the path written in the source, like
+	// go/packages, which differs from the package path for vendored
+	// packages.
+	for _, f := range p.Syntax {
+		for _, spec := range f.Imports {
+			importPath, err := strconv.Unquote(spec.Path.Value)
+			if err != nil || importPath == "C" {
+				continue
+			}
+			if imported := importedPackage(tpkg, importPath); imported != nil {
+				p.Imports[importPath] = &packages.Package{
+					Name:    imported.Name(),
+					PkgPath: imported.Path(),
+					Types:   imported,
+				}
+			}
+		}
+	}
 	return p, nil
 }
 
-// ParseAST parses the given files for a package named main.
+// importedPackage returns the package that an import of importPath in pkg
+// refers to.
+func importedPackage(pkg *types.Package, importPath string) *types.Package {
+	var candidates []*types.Package
+	for _, imported := range pkg.Imports() {
+		if imported.Path() == importPath {
+			return imported
+		}
+		// Vendored packages end in /vendor/ followed by importPath.
+		if strings.HasSuffix(imported.Path(), "/vendor/"+importPath) {
+			candidates = append(candidates, imported)
+		}
+	}
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+	return nil
+}
+
+// ParseAST parses the given files for a package named name.
 //
 // Only files with a matching package statement will be part of the AST
 // returned.
@@ -268,7 +442,7 @@ func ParseAST(name string, files []string) (*token.FileSet, []*ast.File, []strin
 
 	// Did we parse anything?
 	if len(astFiles) == 0 {
-		return nil, nil, nil, fmt.Errorf("no valid `main` package files found in %v", files)
+		return nil, nil, nil, fmt.Errorf("no valid `%s` package files found in %v", name, files)
 	}
 
 	// The order of types.Info.InitOrder depends on this list of files
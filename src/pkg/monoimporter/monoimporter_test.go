@@ -0,0 +1,332 @@
+// Copyright 2020 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package monoimporter
+
+import (
+	"go/build"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/u-root/gobusybox/src/pkg/golang"
+)
+
+// writeModule writes a module example.com/m with a package gen that uses
+// generics, whose export data is only written in the unified IR format.
+func writeModule(t *testing.T, dir string) {
+	t.Helper()
+	writeFiles(t, dir, map[string]string{
+		"go.mod": "module example.com/m\n\ngo 1.18\n",
+		"gen/gen.go": `package gen
+
+import "fmt"
+
+type Box[T any] struct{ V T }
+
+func Wrap[T any](v T) Box[T] { return Box[T]{v} }
+
+func (b Box[T]) String() string { return fmt.Sprint(b.V) }
+`,
+	})
+}
+
+// goEnv returns a build environment that does not use the network.
+func goEnv(t *testing.T) golang.Environ {
+	t.Helper()
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+	os.Setenv("GOPROXY", "off")
+	env := golang.Default()
+	env.GO111MODULE = "on"
+	return env
+}
+
+func checkGen(t *testing.T, imp types.Importer) {
+	t.Helper()
+	pkg, err := imp.Import("example.com/m/gen")
+	if err != nil {
+		t.Fatalf("Import(example.com/m/gen) = %v", err)
+	}
+	box, ok := pkg.Scope().Lookup("Box").(*types.TypeName)
+	if !ok {
+		t.Fatalf("gen.Box not found in %v", pkg.Scope().Names())
+	}
+	if n := box.Type().(*types.Named).TypeParams().Len(); n != 1 {
+		t.Errorf("gen.Box has %d type parameters, want 1", n)
+	}
+	if obj, _, _ := types.LookupFieldOrMethod(box.Type(), false, pkg, "String"); obj == nil {
+		t.Errorf("gen.Box has no String method")
+	}
+}
+
+func TestExportsFromGoList(t *testing.T) {
+	env := goEnv(t)
+	dir, err := ioutil.TempDir("", "test-monoimporter-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeModule(t, dir)
+
+	exports, err := ExportsFromGoList(env, dir, "./gen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pkg := range []string{"example.com/m/gen", "fmt"} {
+		if _, ok := exports[pkg]; !ok {
+			t.Errorf("ExportsFromGoList has no export data for %s", pkg)
+		}
+	}
+
+	imp := NewFromExports(exports)
+	checkGen(t, imp)
+	fmtPkg, err := imp.Import("fmt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmtPkg.Scope().Lookup("Println") == nil {
+		t.Errorf("fmt.Println not found")
+	}
+	if _, err := imp.Import("example.com/m/missing"); err == nil {
+		t.Errorf("Import(example.com/m/missing) = nil, want error")
+	}
+}
+
+func TestArchives(t *testing.T) {
+	env := goEnv(t)
+	dir, err := ioutil.TempDir("", "test-monoimporter-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeModule(t, filepath.Join(dir, "src"))
+
+	ctxt := build.Default
+	ctxt.GOOS, ctxt.GOARCH = "linux", "amd64"
+	env.GOOS, env.GOARCH = ctxt.GOOS, ctxt.GOARCH
+
+	// Archives written by the installed toolchain, in a directory layout
+	// like rules_go's stdlib, and as a single archive like rules_go's
+	// dependencies.
+	for _, tt := range []struct {
+		name  string
+		out   string
+		archs []string
+	}{
+		{
+			name:  "directory",
+			out:   "pkg/linux_amd64/example.com/m/gen.a",
+			archs: []string{filepath.Join(dir, "pkg")},
+		},
+		{
+			name:  "archive",
+			out:   "bazel-out/gen/gen.a",
+			archs: []string{filepath.Join(dir, "bazel-out/gen/gen.a")},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			out := filepath.Join(dir, tt.out)
+			cmd := env.GoCmd("build", "-o", out, "./gen")
+			cmd.Dir = filepath.Join(dir, "src")
+			if b, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("go build: %v\n%s", err, b)
+			}
+			checkGen(t, New(ctxt, tt.archs, nil))
+		})
+	}
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestImportFromVendor(t *testing.T) {
+	env := goEnv(t)
+	dir, err := ioutil.TempDir("", "test-monoimporter-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A GOPATH with a vendored copy of x/y that differs from x/y.
+	writeFiles(t, filepath.Join(dir, "src"), map[string]string{
+		"example.com/m/cmd/main.go":     "package main\n\nimport \"x/y\"\n\nfunc main() { println(y.Where) }\n",
+		"example.com/m/vendor/x/y/y.go": "package y\n\nconst Where = \"vendored\"\n",
+		"x/y/y.go":                      "package y\n\nconst Where = \"top\"\n",
+	})
+	env.GO111MODULE = "off"
+	env.GOPATH = dir
+	exports, err := ExportsFromGoList(env, filepath.Join(dir, "src/example.com/m"), "./cmd", "x/y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	imp := NewFromExports(exports)
+
+	for _, tt := range []struct {
+		dir  string
+		want string
+	}{
+		{dir: filepath.Join(dir, "src/example.com/m/cmd"), want: "vendored"},
+		{dir: filepath.Join(dir, "src/example.com/m"), want: "vendored"},
+		{dir: filepath.Join(dir, "src/example.com/other"), want: "top"},
+		{dir: "", want: "top"},
+	} {
+		pkg, err := imp.ImportFrom("x/y", tt.dir, 0)
+		if err != nil {
+			t.Errorf("ImportFrom(x/y, %q) = %v", tt.dir, err)
+			continue
+		}
+		c, ok := pkg.Scope().Lookup("Where").(*types.Const)
+		if !ok {
+			t.Errorf("ImportFrom(x/y, %q): y.Where not found", tt.dir)
+			continue
+		}
+		if got := strings.Trim(c.Val().String(), `"`); got != tt.want {
+			t.Errorf("ImportFrom(x/y, %q): y.Where = %q, want %q", tt.dir, got, tt.want)
+		}
+	}
+}
+
+func TestAmbiguousArchives(t *testing.T) {
+	env := goEnv(t)
+	dir, err := ioutil.TempDir("", "test-monoimporter-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeModule(t, filepath.Join(dir, "src"))
+
+	// Two archives for packages that have the base name gen.
+	var archs []string
+	for _, out := range []string{"bazel-out/a/gen.a", "bazel-out/b/gen.a"} {
+		out = filepath.Join(dir, out)
+		cmd := env.GoCmd("build", "-o", out, "./gen")
+		cmd.Dir = filepath.Join(dir, "src")
+		if b, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("go build: %v\n%s", err, b)
+		}
+		archs = append(archs, out)
+	}
+
+	imp := New(build.Default, archs, nil)
+	if _, err := imp.Import("example.com/m/gen"); err == nil || !strings.Contains(err.Error(), "ambiguous") {
+		t.Errorf("Import(example.com/m/gen) = %v, want ambiguity error", err)
+	}
+
+	// An import map resolves the ambiguity.
+	imp = New(build.Default, archs, nil)
+	imp.AddExports(map[string]string{"example.com/m/gen": archs[1]})
+	checkGen(t, imp)
+}
+
+func TestParseImportMap(t *testing.T) {
+	for _, tt := range []struct {
+		entries []string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			entries: []string{"a/b=a/b.a", "c=c.x", "a/b=a/b.a"},
+			want:    map[string]string{"a/b": "a/b.a", "c": "c.x"},
+		},
+		{
+			entries: []string{"a/b=x/b.a", "a/b=y/b.a"},
+			wantErr: true,
+		},
+		{
+			entries: []string{"a/b"},
+			wantErr: true,
+		},
+		{
+			entries: []string{"=b.a"},
+			wantErr: true,
+		},
+		{
+			entries: []string{"a/b="},
+			wantErr: true,
+		},
+	} {
+		got, err := ParseImportMap(tt.entries)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseImportMap(%v) = %v, want error %t", tt.entries, err, tt.wantErr)
+		} else if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseImportMap(%v) = %v, want %v", tt.entries, got, tt.want)
+		}
+	}
+}
+
+func TestLoadWithOpts(t *testing.T) {
+	env := goEnv(t)
+	dir, err := ioutil.TempDir("", "test-monoimporter-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeModule(t, dir)
+	writeFiles(t, dir, map[string]string{
+		"use/use.go": `package use
+
+import "example.com/m/gen"
+
+var a = b.String()
+
+var b = gen.Wrap(1)
+
+func F() string { return gen.Wrap("x").String() }
+`,
+		"use/use_test.go": "package use_test\n",
+	})
+	exports, err := ExportsFromGoList(env, dir, "./gen")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := []string{filepath.Join(dir, "use/use.go"), filepath.Join(dir, "use/use_test.go")}
+	p, err := LoadWithOpts("example.com/m/use", files, NewFromExports(exports), &LoadOpts{Name: "use"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Name != "use" || len(p.Syntax) != 1 {
+		t.Errorf("LoadWithOpts = package %s with %d files, want use with 1 file", p.Name, len(p.Syntax))
+	}
+	var order []string
+	for _, init := range p.TypesInfo.InitOrder {
+		order = append(order, init.Lhs[0].Name())
+	}
+	if want := []string{"b", "a"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("InitOrder = %v, want %v", order, want)
+	}
+	// Function bodies are type-checked.
+	var uses []string
+	for id, obj := range p.TypesInfo.Uses {
+		if obj.Name() == "Wrap" {
+			uses = append(uses, p.Fset.Position(id.Pos()).String())
+		}
+	}
+	if len(uses) != 2 {
+		t.Errorf("gen.Wrap is used at %v, want 2 uses", uses)
+	}
+	if len(p.TypesInfo.Selections) != 2 {
+		t.Errorf("TypesInfo.Selections has %d selections, want 2", len(p.TypesInfo.Selections))
+	}
+	if dep, ok := p.Imports["example.com/m/gen"]; !ok || dep.Types == nil {
+		t.Errorf("Imports[example.com/m/gen] = %v, want type-checked package", dep)
+	}
+}
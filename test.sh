@@ -38,7 +38,7 @@ function ctrl_c() {
 }
 trap ctrl_c INT
 
-(cd $GOPATH_TMPDIR && GOPATH=$GOPATH_TMPDIR GO111MODULE=off go get -u github.com/u-root/u-root)
+git clone --depth=1 https://github.com/u-root/u-root $GOPATH_TMPDIR/src/github.com/u-root/u-root
 GOPATH=$GOPATH_TMPDIR GO111MODULE=off ./src/cmd/makebb/makebb github.com/u-root/u-root/cmds/...
 rm -rf $GOPATH_TMPDIR
 
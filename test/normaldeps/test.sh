@@ -17,4 +17,7 @@ do
   test "$HW" == "test/normaldeps/mod2/hello: test/normaldeps/mod2/v2/hello" || (echo "hello world not right" && exit 1)
 
   rm ./bb
+
+  # Commands must behave the same in the busybox as standalone.
+  GO111MODULE=$GO111MODULE $MAKEBB verify ./cases.json ./mod1/cmd/*
 done